@@ -1,5 +1,14 @@
 package putback
 
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"net/netip"
+	"slices"
+	"time"
+)
+
 // Static type assertion
 var (
 	_ WithBackBuffer            = &BackBuffer{}
@@ -143,17 +152,203 @@ func (b *BackBuffer) Read(p []byte) (n int, err error) {
 
 // Packet holds a single buffer and an associated value of type T. It is used
 // by BackPacketBuffer to store packets that can be put back and read later.
+// OOB and Flags carry the out-of-band data (control messages) and message
+// flags the packet was originally received with, if any.
 type Packet[T any] struct {
 	Buffer []byte
+	OOB    []byte // May be nil
+	Flags  int
 	Assoc  T
+	// Time the packet was buffered at. Packets with a zero Time never
+	// expire.
+	Time time.Time
+
+	// addrPort caches the address of packets put back into a
+	// PutBackUDPConn as a netip.AddrPort, so it is returned unchanged.
+	addrPort netip.AddrPort
+}
+
+// ErrPacketBufferFull is returned by TryPutBack and TryAppend when a packet
+// is put into a BackPacketBuffer that is at its limits and uses the DropError
+// policy. The packet is not stored and the caller keeps ownership of its
+// buffers.
+var ErrPacketBufferFull = errors.New("putback: packet buffer is full")
+
+// DropPolicy selects which packet BackPacketBuffer gives up when adding a
+// packet would exceed its limits.
+type DropPolicy int
+
+const (
+	// DropOldest discards packets from the front of the queue, the ones
+	// that would be read next, until the new packet fits. For packets
+	// queued with Append these are the ones buffered the longest.
+	DropOldest DropPolicy = iota
+	// DropNewest discards the packet being added.
+	DropNewest
+	// DropError refuses the packet being added. TryPutBack and TryAppend
+	// report it with ErrPacketBufferFull and leave the packet to the
+	// caller; the other methods release it.
+	DropError
+)
+
+// PacketLimits bounds the packets a BackPacketBuffer keeps. Zero values mean
+// no limit.
+type PacketLimits struct {
+	MaxPackets int           // Maximum number of buffered packets
+	MaxBytes   int           // Maximum total length of buffered packet buffers
+	Policy     DropPolicy    // What to do when a limit would be exceeded
+	MaxAge     time.Duration // Packets older than this are dropped
+}
+
+// DropStats counts packets given up by a BackPacketBuffer.
+type DropStats struct {
+	Expired  uint64 // Packets dropped because they outlived MaxAge
+	Overflow uint64 // Packets dropped by the DropOldest or DropNewest policy
+	Rejected uint64 // Packets refused by the DropError policy
+	Bytes    uint64 // Total buffer length of expired and overflowed packets
+}
+
+// TruncateMode selects what BackPacketBuffer does with a packet that does not
+// fit into the buffer passed to a read.
+type TruncateMode int
+
+const (
+	// TruncateDiscard copies as much of the packet as fits and drops the
+	// rest, like a datagram socket does. ReadMsg reports MsgTrunc in flags.
+	TruncateDiscard TruncateMode = iota
+	// TruncateKeep copies as much of the packet as fits and keeps the unread
+	// remainder buffered as the next packet. ReadMsg reports MsgTrunc in
+	// flags.
+	TruncateKeep
+	// TruncateError leaves the packet buffered and returns a
+	// *PacketTruncatedError describing the real packet size.
+	TruncateError
+)
+
+// PacketTruncatedError is returned by BackPacketBuffer reads in TruncateError
+// mode when the next packet is larger than the provided buffer. The packet
+// stays buffered so the read can be retried with a large enough buffer.
+type PacketTruncatedError struct {
+	Size   int // Size of the buffered packet
+	BufLen int // Length of the buffer passed to the read
+}
+
+func (e *PacketTruncatedError) Error() string {
+	return fmt.Sprintf("putback: buffered packet of %d bytes does not fit into %d byte buffer", e.Size, e.BufLen)
 }
 
-// BackPacketBuffer stores a stack of packets that can be pushed back and later
-// read in LIFO order. If a BufferPool is present, packet buffers are returned
-// to the pool when the packet is discarded.
+// BackPacketBuffer stores a queue of packets that can be pushed back and later
+// read again. PutBack places a packet at the front of the queue so it is read
+// next (LIFO), while Append places it at the tail so it is read after every
+// packet already buffered (FIFO).
+//
+// A BackPacketBuffer owns the buffers of the packets it stores. If a
+// BufferPool is present, packet buffers are returned to the pool when the
+// packet is read or discarded, so only buffers obtained from the pool may be
+// handed over with PutBack and Append (or their Owned aliases); use the Copy
+// variants for any other slice.
+//
+// Packets are only stamped with the time they were buffered at, and expired,
+// while Limits.MaxAge is set.
 type BackPacketBuffer[T any] struct {
-	Packets []Packet[T] // May be nil
-	Pool    BufferPool  // May be nil
+	// Packets are kept in reverse read order: the last element is read
+	// first. Prefer All, Insert, Remove and Filter, which use read order.
+	// May be nil.
+	Packets  []Packet[T]
+	Pool     BufferPool   // May be nil
+	Truncate TruncateMode // Zero value is TruncateDiscard
+	Limits   PacketLimits // Zero value means unlimited
+	Dropped  DropStats
+
+	// base is the backing array of Packets, which starts at base[off]. The
+	// room in front of it lets packets be queued at the tail in O(1).
+	base []Packet[T]
+	off  int
+	// count and bytes are the number of packets and their total buffer
+	// length as of the last operation.
+	count int
+	bytes int
+}
+
+// aliased reports whether Packets still lives at base[off], that is whether
+// it has not been replaced or reallocated since the last operation.
+func (b *BackPacketBuffer[T]) aliased() bool {
+	return cap(b.Packets) == cap(b.base)-b.off &&
+		(cap(b.Packets) == 0 || &b.Packets[:1][0] == &b.base[b.off])
+}
+
+// adopt takes over the backing array of Packets after it was replaced or
+// reallocated.
+func (b *BackPacketBuffer[T]) adopt() {
+	if !b.aliased() {
+		b.base = b.Packets[:cap(b.Packets)]
+		b.off = 0
+	}
+}
+
+// sync brings the bookkeeping up to date after Packets was changed directly.
+func (b *BackPacketBuffer[T]) sync() {
+	if b.aliased() && b.count == len(b.Packets) {
+		return
+	}
+	b.adopt()
+	b.count = len(b.Packets)
+	b.bytes = 0
+	for _, packet := range b.Packets {
+		b.bytes += len(packet.Buffer)
+	}
+}
+
+// pushFront stores packet at the front of the queue, so it is read next.
+func (b *BackPacketBuffer[T]) pushFront(packet Packet[T]) {
+	b.sync()
+	b.Packets = append(b.Packets, packet)
+	b.adopt()
+	b.count++
+	b.bytes += len(packet.Buffer)
+}
+
+// pushBack stores packet at the tail of the queue, so it is read last.
+func (b *BackPacketBuffer[T]) pushBack(packet Packet[T]) {
+	b.sync()
+	n := len(b.Packets)
+	if b.off == 0 {
+		// Double the room on both ends so alternating front and tail
+		// operations do not reallocate every time.
+		room := max(n, 4)
+		base := make([]Packet[T], room+n+room)
+		copy(base[room:], b.Packets)
+		b.base, b.off = base, room
+	}
+	b.off--
+	b.base[b.off] = packet
+	b.Packets = b.base[b.off : b.off+n+1]
+	b.count++
+	b.bytes += len(packet.Buffer)
+}
+
+// popFront removes and returns the packet at the front of the queue.
+func (b *BackPacketBuffer[T]) popFront() Packet[T] {
+	b.sync()
+	top := len(b.Packets) - 1
+	packet := b.Packets[top]
+	b.Packets[top] = Packet[T]{}
+	b.Packets = b.Packets[:top]
+	b.count--
+	b.bytes -= len(packet.Buffer)
+	return packet
+}
+
+// popBack removes and returns the packet at the tail of the queue.
+func (b *BackPacketBuffer[T]) popBack() Packet[T] {
+	b.sync()
+	packet := b.Packets[0]
+	b.Packets[0] = Packet[T]{}
+	b.Packets = b.Packets[1:]
+	b.off++
+	b.count--
+	b.bytes -= len(packet.Buffer)
+	return packet
 }
 
 // Wipe clears stored packets and returns their buffers to the pool when
@@ -162,15 +357,132 @@ func (b *BackPacketBuffer[T]) Wipe() {
 	if b == nil {
 		return
 	}
-	if b.Pool != nil {
-		for _, packet := range b.Packets {
-			b.Pool.PutBuffer(packet.Buffer)
-		}
+	for _, packet := range b.Packets {
+		b.release(packet)
 	}
 	b.Packets = nil
+	b.base = nil
+	b.off = 0
+	b.count = 0
+	b.bytes = 0
+}
+
+// drop releases a packet that is given up and accounts it in Dropped.
+func (b *BackPacketBuffer[T]) drop(packet Packet[T], counter *uint64) {
+	*counter++
+	b.Dropped.Bytes += uint64(len(packet.Buffer))
+	b.release(packet)
+}
+
+// Expire drops the packets that are older than Limits.MaxAge. Reads and
+// additions expire packets on their own; Expire is only needed to release
+// stale packets of an otherwise idle buffer, or before inspecting it with
+// PacketsLeft, BytesLeft or All.
+func (b *BackPacketBuffer[T]) Expire() {
+	if b == nil || b.Limits.MaxAge <= 0 {
+		return
+	}
+	b.expire(time.Now())
+}
+
+// expire drops packets that are older than Limits.MaxAge at now.
+func (b *BackPacketBuffer[T]) expire(now time.Time) {
+	b.sync()
+	if b.count == 0 {
+		return
+	}
+	b.Packets = slices.DeleteFunc(b.Packets, func(packet Packet[T]) bool {
+		if packet.Time.IsZero() || now.Sub(packet.Time) < b.Limits.MaxAge {
+			return false
+		}
+		b.bytes -= len(packet.Buffer)
+		b.drop(packet, &b.Dropped.Expired)
+		return true
+	})
+	b.count = len(b.Packets)
+}
+
+// BytesLeft returns the total length of the buffers of all stored packets.
+func (b *BackPacketBuffer[T]) BytesLeft() int {
+	if b == nil {
+		return 0
+	}
+	b.sync()
+	return b.bytes
+}
+
+// full reports whether adding a packet of size bytes would exceed Limits.
+func (b *BackPacketBuffer[T]) full(size int) bool {
+	if b.Limits.MaxPackets > 0 && b.count >= b.Limits.MaxPackets {
+		return true
+	}
+	return b.Limits.MaxBytes > 0 && b.bytes+size > b.Limits.MaxBytes
+}
+
+// add stores a packet at read position i, enforcing Limits. A negative i
+// stands for the tail of the queue. Positions past the tail, which may appear
+// after packets were dropped to make room, are clamped to the tail. Unless
+// an error is returned, the buffer owns the packet afterwards.
+func (b *BackPacketBuffer[T]) add(packet Packet[T], i int) error {
+	if b.Limits.MaxAge > 0 {
+		now := time.Now()
+		if packet.Time.IsZero() {
+			packet.Time = now
+		}
+		b.expire(now)
+	}
+	b.sync()
+	for b.full(len(packet.Buffer)) {
+		switch {
+		case b.Limits.Policy == DropError:
+			b.Dropped.Rejected++
+			return ErrPacketBufferFull
+		case b.Limits.Policy == DropNewest || b.count == 0:
+			b.drop(packet, &b.Dropped.Overflow)
+			return nil
+		}
+		b.drop(b.popFront(), &b.Dropped.Overflow)
+		if i > 0 {
+			i--
+		}
+	}
+	switch {
+	case i == 0:
+		b.pushFront(packet)
+	case i < 0 || i >= b.count:
+		b.pushBack(packet)
+	default:
+		b.Packets = slices.Insert(b.Packets, b.count-i, packet)
+		b.adopt()
+		b.count++
+		b.bytes += len(packet.Buffer)
+	}
+	return nil
+}
+
+// put is like add but releases a packet refused by the DropError policy.
+func (b *BackPacketBuffer[T]) put(packet Packet[T], i int) {
+	if b == nil {
+		return
+	}
+	if err := b.add(packet, i); err != nil {
+		b.release(packet)
+	}
+}
+
+// release returns packet buffers to the pool when one is present.
+func (b *BackPacketBuffer[T]) release(packet Packet[T]) {
+	if b.Pool == nil {
+		return
+	}
+	b.Pool.PutBuffer(packet.Buffer)
+	if packet.OOB != nil {
+		b.Pool.PutBuffer(packet.OOB)
+	}
 }
 
 // PacketsLeft returns the number of packets currently stored in the buffer.
+// Expired packets are counted until the next read, addition or Expire.
 func (b *BackPacketBuffer[T]) PacketsLeft() int {
 	if b == nil {
 		return 0
@@ -178,42 +490,289 @@ func (b *BackPacketBuffer[T]) PacketsLeft() int {
 	return len(b.Packets)
 }
 
-// PutBack pushes a packet (buffer + associated value) onto the stack. The
-// provided buffer slice is not copied; callers that need ownership should
-// ensure the slice won't be modified after PutBack.
+// PutBack pushes a packet (buffer + associated value) onto the stack, handing
+// ownership of bytes to the buffer: the slice is not copied, must not be used
+// by the caller afterwards and is returned to Pool once the packet is read or
+// dropped. Pass only slices obtained from Pool (or any slice when Pool is
+// nil). When the buffer is at its Limits the packet is handled according to
+// Limits.Policy; a packet refused by DropError is released. Use TryPutBack to
+// learn about refused packets.
 func (b *BackPacketBuffer[T]) PutBack(bytes []byte, Assoc T) {
+	b.PutBackMsg(bytes, nil, 0, Assoc)
+}
+
+// PutBackOwned is PutBack under a name that spells out the ownership
+// transfer, as opposed to PutBackCopy.
+func (b *BackPacketBuffer[T]) PutBackOwned(bytes []byte, Assoc T) {
+	b.PutBack(bytes, Assoc)
+}
+
+// PutBackCopy pushes a copy of bytes onto the stack. The copy is placed in a
+// buffer obtained from Pool, so the caller keeps ownership of bytes and may
+// reuse it right away.
+func (b *BackPacketBuffer[T]) PutBackCopy(bytes []byte, Assoc T) {
+	b.addCopy(bytes, Assoc, 0)
+}
+
+// PutBackMsg is like PutBack but also stores the out-of-band data and message
+// flags of the packet so they are returned by a subsequent ReadMsg. Neither
+// bytes nor oob are copied.
+func (b *BackPacketBuffer[T]) PutBackMsg(bytes, oob []byte, flags int, Assoc T) {
+	b.put(Packet[T]{
+		Buffer: bytes,
+		OOB:    oob,
+		Flags:  flags,
+		Assoc:  Assoc,
+	}, 0)
+}
+
+// TryPutBack is like PutBack but takes a whole packet and returns
+// ErrPacketBufferFull if the DropError policy refuses it, in which case
+// ownership of the packet buffers stays with the caller.
+func (b *BackPacketBuffer[T]) TryPutBack(packet Packet[T]) error {
+	if b == nil {
+		return nil
+	}
+	return b.add(packet, 0)
+}
+
+// Append adds a packet (buffer + associated value) to the tail of the queue
+// so it is read after all packets currently buffered. Like PutBack, it takes
+// ownership of bytes and enforces Limits.
+func (b *BackPacketBuffer[T]) Append(bytes []byte, Assoc T) {
+	b.AppendMsg(bytes, nil, 0, Assoc)
+}
+
+// AppendOwned is Append under a name that spells out the ownership transfer,
+// as opposed to AppendCopy.
+func (b *BackPacketBuffer[T]) AppendOwned(bytes []byte, Assoc T) {
+	b.Append(bytes, Assoc)
+}
+
+// AppendCopy adds a copy of bytes to the tail of the queue. See PutBackCopy.
+func (b *BackPacketBuffer[T]) AppendCopy(bytes []byte, Assoc T) {
+	b.addCopy(bytes, Assoc, -1)
+}
+
+// TryAppend is like TryPutBack but adds the packet to the tail of the queue.
+func (b *BackPacketBuffer[T]) TryAppend(packet Packet[T]) error {
+	if b == nil {
+		return nil
+	}
+	return b.add(packet, -1)
+}
+
+// addCopy stores a copy of bytes placed in a buffer obtained from Pool.
+func (b *BackPacketBuffer[T]) addCopy(bytes []byte, Assoc T, i int) {
 	if b == nil {
 		return
 	}
-	b.Packets = append(b.Packets, Packet[T]{
+	buf := getBuffer(b.Pool, len(bytes))
+	copy(buf, bytes)
+	b.put(Packet[T]{Buffer: buf, Assoc: Assoc}, i)
+}
+
+// clone returns a copy of packet whose buffers are obtained from pool.
+func clone[T any](pool BufferPool, packet Packet[T]) Packet[T] {
+	buf := getBuffer(pool, len(packet.Buffer))
+	copy(buf, packet.Buffer)
+	packet.Buffer = buf
+	if packet.OOB != nil {
+		oob := getBuffer(pool, len(packet.OOB))
+		copy(oob, packet.OOB)
+		packet.OOB = oob
+	}
+	return packet
+}
+
+// AppendMsg is like Append but also stores the out-of-band data and message
+// flags of the packet.
+func (b *BackPacketBuffer[T]) AppendMsg(bytes, oob []byte, flags int, Assoc T) {
+	b.put(Packet[T]{
 		Buffer: bytes,
+		OOB:    oob,
+		Flags:  flags,
 		Assoc:  Assoc,
-	})
+	}, -1)
 }
 
-// ReadFrom pops the most recently PutBack packet and copies its buffer into
+// ReadFrom pops the packet at the front of the queue and copies its buffer into
 // p (up to len(p)). It returns the number of bytes copied and the associated
 // value. If no packets are available it returns zero values. When a pool is
-// present the packet buffer is returned to the pool. ReadFrom never returns
-// a non-nil error.
+// present the packet buffer is returned to the pool. Packets larger than p
+// are handled according to Truncate; ReadFrom only returns a non-nil error
+// in TruncateError mode. Use TryReadFrom to tell an empty buffer apart from a
+// zero-length packet.
 func (b *BackPacketBuffer[T]) ReadFrom(p []byte) (n int, assoc T, err error) {
+	n, assoc, _, err = b.TryReadFrom(p)
+	return
+}
+
+// TryReadFrom is like ReadFrom but additionally reports whether a buffered
+// packet was found. ok is true for zero-length packets and when p is empty.
+func (b *BackPacketBuffer[T]) TryReadFrom(p []byte) (n int, assoc T, ok bool, err error) {
+	n, _, _, assoc, ok, err = b.TryReadMsg(p, nil)
+	return
+}
+
+// ReadMsg is like ReadFrom but additionally copies the stored out-of-band
+// data into oob (up to len(oob)) and returns the stored message flags.
+// MsgTrunc and MsgCtrunc are added to flags when the packet or its
+// out-of-band data did not fit.
+func (b *BackPacketBuffer[T]) ReadMsg(p, oob []byte) (n, oobn, flags int, assoc T, err error) {
+	n, oobn, flags, assoc, _, err = b.TryReadMsg(p, oob)
+	return
+}
+
+// TryReadMsg is like ReadMsg but additionally reports whether a buffered
+// packet was found.
+func (b *BackPacketBuffer[T]) TryReadMsg(p, oob []byte) (n, oobn, flags int, assoc T, ok bool, err error) {
+	n, oobn, flags, packet, ok, err := b.readMsg(p, oob)
+	return n, oobn, flags, packet.Assoc, ok, err
+}
+
+// readMsg implements TryReadMsg, returning the whole packet that was read.
+// Only its metadata may be used; its buffers may be back in Pool already.
+func (b *BackPacketBuffer[T]) readMsg(p, oob []byte) (n, oobn, flags int, packet Packet[T], ok bool, err error) {
 	if b == nil {
 		return
 	}
-	if len(b.Packets) == 0 {
+	b.Expire()
+	b.sync()
+	if b.count == 0 {
+		return
+	}
+	ok = true
+	top := len(b.Packets) - 1
+	packet = b.Packets[top]
+	if len(packet.Buffer) > len(p) && b.Truncate == TruncateError {
+		err = &PacketTruncatedError{Size: len(packet.Buffer), BufLen: len(p)}
 		return
 	}
-	packet := b.Packets[len(b.Packets)-1]
-	b.Packets[len(b.Packets)-1] = Packet[T]{}
-	b.Packets = b.Packets[:len(b.Packets)-1]
 	n = copy(p, packet.Buffer)
-	assoc = packet.Assoc
-	if b.Pool != nil {
-		b.Pool.PutBuffer(packet.Buffer)
+	oobn = copy(oob, packet.OOB)
+	flags = packet.Flags
+	if n < len(packet.Buffer) {
+		flags |= MsgTrunc
+	}
+	if oobn < len(packet.OOB) {
+		flags |= MsgCtrunc
+	}
+	if n < len(packet.Buffer) && b.Truncate == TruncateKeep {
+		// Move the remainder to the start of the buffer so the pool
+		// later gets back the slice it handed out.
+		rest := copy(packet.Buffer, packet.Buffer[n:])
+		b.bytes -= n
+		if b.Pool != nil && packet.OOB != nil {
+			b.Pool.PutBuffer(packet.OOB)
+		}
+		b.Packets[top] = Packet[T]{
+			Buffer:   packet.Buffer[:rest],
+			Assoc:    packet.Assoc,
+			Time:     packet.Time,
+			addrPort: packet.addrPort,
+		}
+	} else {
+		b.release(b.popFront())
 	}
 	return
 }
 
+// All returns an iterator over the buffered packets in read order, yielding
+// the read position of each packet along with it. Packet buffers are owned
+// by the BackPacketBuffer and must not be retained or modified. The buffer
+// must not be changed while iterating.
+func (b *BackPacketBuffer[T]) All() iter.Seq2[int, Packet[T]] {
+	return func(yield func(int, Packet[T]) bool) {
+		if b == nil {
+			return
+		}
+		for i := range b.Packets {
+			if !yield(i, b.Packets[len(b.Packets)-1-i]) {
+				return
+			}
+		}
+	}
+}
+
+// Insert places packet at read position i, so it is read after i other
+// packets; 0 is the front and PacketsLeft() the tail of the queue. Ownership
+// of the packet buffers is handed over as with PutBack and Limits are
+// enforced; like TryPutBack, Insert returns ErrPacketBufferFull for a packet
+// refused by the DropError policy. Insert panics if i is out of range.
+func (b *BackPacketBuffer[T]) Insert(i int, packet Packet[T]) error {
+	if i < 0 || i > b.PacketsLeft() {
+		panic(fmt.Sprintf("putback: insert position %d out of range [0:%d]", i, b.PacketsLeft()))
+	}
+	return b.add(packet, i)
+}
+
+// Remove drops the packet at read position i and returns its buffers to
+// Pool. Remove panics if i is out of range.
+func (b *BackPacketBuffer[T]) Remove(i int) {
+	if i < 0 || i >= b.PacketsLeft() {
+		panic(fmt.Sprintf("putback: remove position %d out of range [0:%d]", i, b.PacketsLeft()))
+	}
+	switch idx := len(b.Packets) - 1 - i; idx {
+	case len(b.Packets) - 1:
+		b.release(b.popFront())
+	case 0:
+		b.release(b.popBack())
+	default:
+		b.sync()
+		b.release(b.Packets[idx])
+		b.bytes -= len(b.Packets[idx].Buffer)
+		b.Packets = slices.Delete(b.Packets, idx, idx+1)
+		b.count--
+	}
+}
+
+// Filter drops every packet for which keep returns false and returns their
+// buffers to Pool. keep is called in read order and the order of the
+// remaining packets is preserved.
+func (b *BackPacketBuffer[T]) Filter(keep func(Packet[T]) bool) {
+	if b == nil {
+		return
+	}
+	b.sync()
+	// Compact towards the end of the slice, walking in read order.
+	w := len(b.Packets)
+	for r := len(b.Packets) - 1; r >= 0; r-- {
+		packet := b.Packets[r]
+		if keep(packet) {
+			w--
+			b.Packets[w] = packet
+		} else {
+			b.bytes -= len(packet.Buffer)
+			b.release(packet)
+		}
+	}
+	n := copy(b.Packets, b.Packets[w:])
+	clear(b.Packets[n:])
+	b.Packets = b.Packets[:n]
+	b.count = n
+}
+
+// PeekFrom copies the packet at the front of the queue into p (up to len(p))
+// without removing it, so the next read returns the same packet. ok reports
+// whether a buffered packet was found.
+func (b *BackPacketBuffer[T]) PeekFrom(p []byte) (n int, assoc T, ok bool) {
+	packet, ok := b.peek()
+	return copy(p, packet.Buffer), packet.Assoc, ok
+}
+
+// peek returns the packet at the front of the queue without removing it.
+func (b *BackPacketBuffer[T]) peek() (packet Packet[T], ok bool) {
+	if b == nil {
+		return
+	}
+	b.Expire()
+	if len(b.Packets) == 0 {
+		return
+	}
+	return b.Packets[len(b.Packets)-1], true
+}
+
 // BackPacketBuffer returns the receiver to satisfy the WithBackPacketBuffer[T] interface.
 func (b *BackPacketBuffer[T]) BackPacketBuffer() *BackPacketBuffer[T] {
 	return b
@@ -249,14 +808,20 @@ func NewBackBuffer(pool BufferPool, parent WithBackBuffer, bufs ...[]byte) BackB
 }
 
 // NewBackPacketBuffer constructs a BackPacketBuffer optionally reusing
-// packets from parent and appending the provided packets. The returned
+// packets from parent. packets uses the layout of Packets: its last element
+// is read first, and the packets of parent are read before any of them.
+// Ownership of the provided packets is handed over to the returned buffer,
+// while the packets of parent are deep-copied into buffers obtained from
+// pool, so the same buffer never sits in two BackPacketBuffers.
 func NewBackPacketBuffer[T any](pool BufferPool, parent WithBackPacketBuffer[T], packets ...Packet[T]) BackPacketBuffer[T] {
 	var packs []Packet[T]
 	if parent != nil {
-		packs = concatCopy(parent.BackPacketBuffer().Packets, packs)
 		if pool == nil {
 			pool = parent.BackPacketBuffer().Pool
 		}
+		for _, packet := range parent.BackPacketBuffer().Packets {
+			packs = append(packs, clone(pool, packet))
+		}
 	}
 	packs = concatCopy(packets, packs)
 	return BackPacketBuffer[T]{
@@ -0,0 +1,68 @@
+package putback
+
+import (
+	"bufio"
+	"io"
+	"net"
+)
+
+// readAhead hands the bytes buffered in br to putBack, which must copy them,
+// and discards them from br.
+func readAhead(br *bufio.Reader, putBack func([]byte)) {
+	n := br.Buffered()
+	if n == 0 {
+		return
+	}
+	b, _ := br.Peek(n)
+	putBack(b)
+	_, _ = br.Discard(n)
+}
+
+// FromHijack turns the connection and buffered reader-writer returned by
+// http.Hijacker.Hijack into a PutBackConn, or a PutBackTCPConn for TCP
+// connections, with the bytes the server had already read from the client
+// put back. Anything left in the writer is flushed to the connection first.
+// Connections that already support put-back, such as those of a Mux route,
+// get the bytes put back in place. brw is empty afterwards and should no
+// longer be used.
+func FromHijack(conn net.Conn, brw *bufio.ReadWriter) (net.Conn, error) {
+	if brw != nil && brw.Writer != nil && brw.Writer.Buffered() > 0 {
+		if err := brw.Flush(); err != nil {
+			return conn, err
+		}
+	}
+	if brw == nil {
+		return withPutBack(conn, nil), nil
+	}
+	return WrapConnBufio(conn, brw.Reader, nil), nil
+}
+
+// FromBufio returns a reader that yields the bytes buffered in br followed
+// by the rest of under, the reader br was reading from, so br can be
+// dropped without losing its read-ahead. If under already supports
+// put-back, the bytes are put back into it and under is returned; otherwise
+// it is wrapped in a PutBackReader. br is empty afterwards and should no
+// longer be used.
+func FromBufio(br *bufio.Reader, under io.Reader) io.Reader {
+	r, ok := under.(PutBacker)
+	if !ok {
+		r = &PutBackReader{Reader: under}
+	}
+	if br != nil {
+		readAhead(br, r.PutBack)
+	}
+	return r
+}
+
+// WrapConnBufio is like WrapConn, with the bytes buffered in br, which was
+// reading from conn, put back. The result is a plain net.Conn with every
+// byte in place, which can be handed to code that does not know about br.
+// Connections that already support put-back get the bytes put back in
+// place. br is empty afterwards and should no longer be used.
+func WrapConnBufio(conn net.Conn, br *bufio.Reader, pool BufferPool) net.Conn {
+	conn = withPutBack(conn, pool)
+	if br != nil {
+		readAhead(br, conn.(PutBacker).PutBack)
+	}
+	return conn
+}
@@ -0,0 +1,162 @@
+package putback_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asciimoth/putback"
+)
+
+// hijackServer starts a server whose handler hijacks every request, passes
+// the result through FromHijack and sends the conn on the returned channel.
+func hijackServer(t *testing.T, respond string) (*httptest.Server, <-chan net.Conn) {
+	t.Helper()
+	conns := make(chan net.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("Hijack: %v", err)
+			return
+		}
+		if respond != "" {
+			_, _ = brw.WriteString(respond)
+		}
+		pb, err := putback.FromHijack(conn, brw)
+		if err != nil {
+			t.Errorf("FromHijack: %v", err)
+		}
+		conns <- pb
+	}))
+	t.Cleanup(srv.Close)
+	return srv, conns
+}
+
+func TestFromHijack_ReadAhead(t *testing.T) {
+	srv, conns := hijackServer(t, "")
+	const early = "early bytes sent right after the request"
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n" + early)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	conn := <-conns
+	defer conn.Close()
+	tcp, ok := conn.(*putback.PutBackTCPConn)
+	if !ok {
+		t.Fatalf("conn is %T", conn)
+	}
+	if err := tcp.SetKeepAlive(true); err != nil {
+		t.Fatalf("SetKeepAlive: %v", err)
+	}
+	if left := tcp.Buffer.BytesLeft(); left != len(early) {
+		t.Fatalf("buffered %d bytes, want %d", left, len(early))
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len(early))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != early {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestFromHijack_FlushesWriter(t *testing.T) {
+	const resp = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n"
+	srv, conns := hijackServer(t, resp)
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn := <-conns
+	defer conn.Close()
+
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("response = %v, %v", res, err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestFromBufio(t *testing.T) {
+	under := strings.NewReader("first line\nsecond line\nrest")
+	br := bufio.NewReaderSize(under, 16)
+	line, err := br.ReadString('\n')
+	if err != nil || line != "first line\n" {
+		t.Fatalf("ReadString = %q, %v", line, err)
+	}
+	r := putback.FromBufio(br, under)
+	if br.Buffered() != 0 {
+		t.Fatalf("bufio.Reader still holds %d bytes", br.Buffered())
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "second line\nrest" {
+		t.Fatalf("rest = %q", rest)
+	}
+}
+
+func TestFromBufio_PutBacker(t *testing.T) {
+	under := &putback.PutBackReader{Reader: strings.NewReader("abcdef")}
+	br := bufio.NewReader(under)
+	if b, _ := br.ReadByte(); b != 'a' {
+		t.Fatalf("ReadByte = %q", b)
+	}
+	if r := putback.FromBufio(br, under); r != under {
+		t.Fatalf("FromBufio wrapped a PutBackReader again: %T", r)
+	}
+	if rest, _ := io.ReadAll(under); string(rest) != "bcdef" {
+		t.Fatalf("rest = %q", rest)
+	}
+}
+
+func TestWrapConnBufio(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() { _, _ = client.Write([]byte("HELLO v1\npayload")) }()
+
+	br := bufio.NewReader(server)
+	greeting, err := br.ReadString('\n')
+	if err != nil || greeting != "HELLO v1\n" {
+		t.Fatalf("ReadString = %q, %v", greeting, err)
+	}
+	pool := &countingPool{}
+	conn := putback.WrapConnBufio(server, br, pool)
+	defer conn.Close()
+	pb, ok := conn.(*putback.PutBackConn)
+	if !ok {
+		t.Fatalf("conn is %T", conn)
+	}
+	if left := pb.Buffer.BytesLeft(); left != len("payload") {
+		t.Fatalf("buffered %d bytes", left)
+	}
+	buf := make([]byte, len("payload"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "payload" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	if pool.got == 0 || pool.got != pool.put {
+		t.Fatalf("pool got %d, put %d buffers", pool.got, pool.put)
+	}
+
+	// Wrapping a put-back conn again keeps it.
+	if again := putback.WrapConnBufio(conn, bufio.NewReader(conn), nil); again != conn {
+		t.Fatalf("WrapConnBufio wrapped a PutBackConn again: %T", again)
+	}
+}
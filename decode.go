@@ -0,0 +1,68 @@
+package putback
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"io"
+)
+
+// recordingReader remembers everything read through it, so it can be put
+// back.
+type recordingReader struct {
+	r    io.Reader
+	read []byte
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.read = append(rr.read, p[:n]...)
+	return n, err
+}
+
+// exactReader is an io.ByteReader, so decoders such as gob.Decoder read
+// from it directly instead of through a read-ahead bufio.Reader.
+type exactReader struct {
+	io.Reader
+}
+
+func (er exactReader) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(er.Reader, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// DecodeJSON decodes one JSON value from r into v and puts back the bytes
+// json.Decoder read past it, so r is positioned right after the value.
+// Whitespace following the value, such as a newline delimiter, is left in r.
+// If decoding fails, everything read is put back and r is unchanged.
+func DecodeJSON(r PutBacker, v any) error {
+	rec := &recordingReader{r: r}
+	dec := json.NewDecoder(rec)
+	if err := dec.Decode(v); err != nil {
+		r.PutBack(rec.read)
+		return err
+	}
+	r.PutBack(rec.read[dec.InputOffset():])
+	return nil
+}
+
+// NewGobDecoder returns a gob.Decoder reading from r that never reads past
+// the messages it decodes, so the bytes after the last decoded value stay
+// in r.
+func NewGobDecoder(r io.Reader) *gob.Decoder {
+	return gob.NewDecoder(exactReader{r})
+}
+
+// DecodeGob decodes one gob value, with the type definitions sent ahead of
+// it, from r into v, leaving r positioned right after the value. If
+// decoding fails, everything read is put back and r is unchanged.
+func DecodeGob(r PutBacker, v any) error {
+	rec := &recordingReader{r: r}
+	if err := NewGobDecoder(rec).Decode(v); err != nil {
+		r.PutBack(rec.read)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package putback_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/asciimoth/putback"
+)
+
+type handshake struct {
+	Version int
+	Name    string
+}
+
+func TestDecodeJSON(t *testing.T) {
+	r := &putback.PutBackReader{Reader: strings.NewReader(`{"Version":2,"Name":"x"}` + "\nraw\x00bytes")}
+	var h handshake
+	if err := putback.DecodeJSON(r, &h); err != nil {
+		t.Fatalf("DecodeJSON: %v", err)
+	}
+	if h != (handshake{2, "x"}) {
+		t.Fatalf("handshake = %+v", h)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "\nraw\x00bytes" {
+		t.Fatalf("rest = %q", rest)
+	}
+}
+
+func TestDecodeJSON_Error(t *testing.T) {
+	const data = `{"Version":"two"} raw`
+	r := &putback.PutBackReader{Reader: iotest.HalfReader(strings.NewReader(data))}
+	var h handshake
+	if err := putback.DecodeJSON(r, &h); err == nil {
+		t.Fatalf("DecodeJSON succeeded")
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != data {
+		t.Fatalf("stream = %q", rest)
+	}
+}
+
+func TestDecodeGob(t *testing.T) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(handshake{3, "gob"}); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	buf.WriteString("raw\x00bytes")
+	r := &putback.PutBackReader{Reader: &buf}
+
+	var h handshake
+	if err := putback.DecodeGob(r, &h); err != nil {
+		t.Fatalf("DecodeGob: %v", err)
+	}
+	if h != (handshake{3, "gob"}) {
+		t.Fatalf("handshake = %+v", h)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "raw\x00bytes" {
+		t.Fatalf("rest = %q", rest)
+	}
+}
+
+func TestDecodeGob_Error(t *testing.T) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(struct{ Other string }{"x"}); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	data := buf.String()
+	r := &putback.PutBackReader{Reader: strings.NewReader(data)}
+	var h handshake
+	if err := putback.DecodeGob(r, &h); err == nil {
+		t.Fatalf("DecodeGob succeeded")
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != data {
+		t.Fatalf("stream changed")
+	}
+}
+
+func TestNewGobDecoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	for i := range 2 {
+		if err := enc.Encode(handshake{Version: i}); err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+	}
+	buf.WriteString("tail")
+	dec := putback.NewGobDecoder(&buf)
+	for i := range 2 {
+		var h handshake
+		if err := dec.Decode(&h); err != nil || h.Version != i {
+			t.Fatalf("Decode %d = %+v, %v", i, h, err)
+		}
+	}
+	if buf.String() != "tail" {
+		t.Fatalf("rest = %q", buf.String())
+	}
+}
@@ -0,0 +1,418 @@
+package putback
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Static type assertion
+var (
+	_ net.Listener = &PacketListener{}
+	_ net.Conn     = &PacketSession{}
+)
+
+// acceptBacklog is the number of new sessions that may wait for Accept
+// before datagrams from further unknown remote addresses are dropped.
+const acceptBacklog = 64
+
+// PacketListener demultiplexes datagrams received on a shared PacketConn into
+// per remote address sessions. Accept returns a PacketSession for every new
+// remote address; the datagram that created the session is already buffered
+// in it, so protocols may be sniffed one peer at a time.
+//
+// A PacketListener owns the PacketConn it was created with: a single reader
+// goroutine consumes it until the listener is closed. If conn is a
+// PutBackPacketConn or a PutBackUDPConn, packets buffered there are
+// dispatched first.
+type PacketListener struct {
+	conn        net.PacketConn
+	pool        BufferPool
+	idleTimeout time.Duration
+
+	accept chan *PacketSession
+	done   chan struct{}
+	once   sync.Once
+
+	mu       sync.Mutex
+	sessions map[string]*PacketSession
+	limits   PacketLimits
+	err      error // error that stopped the reader, if any
+}
+
+// NewPacketListener starts demultiplexing datagrams received on conn.
+// Sessions that neither receive nor send a datagram for idleTimeout after
+// Accept returned them are closed; sessions waiting to be accepted do not
+// expire. A zero idleTimeout disables expiry. Datagrams are received into a
+// single scratch buffer and copied out at their real size, into buffers from
+// pool if it is non-nil.
+func NewPacketListener(conn net.PacketConn, idleTimeout time.Duration, pool BufferPool) *PacketListener {
+	l := &PacketListener{
+		conn:        conn,
+		pool:        pool,
+		idleTimeout: idleTimeout,
+		accept:      make(chan *PacketSession, acceptBacklog),
+		done:        make(chan struct{}),
+		sessions:    make(map[string]*PacketSession),
+	}
+	go l.serve()
+	return l
+}
+
+// serve reads datagrams from the shared conn and dispatches them to sessions.
+func (l *PacketListener) serve() {
+	scratch := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := l.conn.ReadFrom(scratch)
+		if err != nil {
+			l.mu.Lock()
+			select {
+			case <-l.done:
+			default:
+				l.err = err
+			}
+			l.mu.Unlock()
+			_ = l.Close()
+			return
+		}
+		buf := getBuffer(l.pool, n)
+		copy(buf, scratch[:n])
+		l.dispatch(buf, addr)
+	}
+}
+
+// dispatch queues a datagram in the session of its remote address, creating
+// the session if needed.
+func (l *PacketListener) dispatch(buf []byte, addr net.Addr) {
+	key := addr.String()
+	l.mu.Lock()
+	s, ok := l.sessions[key]
+	select {
+	case <-l.done:
+		l.mu.Unlock()
+		releaseBuffer(l.pool, buf)
+		return
+	default:
+	}
+	if !ok {
+		s = newPacketSession(l, addr, key)
+		select {
+		case l.accept <- s:
+			l.sessions[key] = s
+		default:
+			// Backlog is full; drop the datagram like an overflowing
+			// socket receive buffer would.
+			l.mu.Unlock()
+			s.stop()
+			releaseBuffer(l.pool, buf)
+			return
+		}
+	}
+	l.mu.Unlock()
+	s.deliver(buf, addr)
+}
+
+// SetSessionLimits sets the PacketLimits of sessions created from now on, so
+// datagrams parked for a slow consumer are bounded in count, size and age.
+func (l *PacketListener) SetSessionLimits(limits PacketLimits) {
+	l.mu.Lock()
+	l.limits = limits
+	l.mu.Unlock()
+}
+
+// Accept waits for and returns the next session. The returned net.Conn is a
+// *PacketSession.
+func (l *PacketListener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.accept:
+		s.startIdle()
+		return s, nil
+	case <-l.done:
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return nil, l.err
+	}
+	return nil, net.ErrClosed
+}
+
+// Close closes the shared PacketConn and every session of the listener.
+func (l *PacketListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.conn.Close()
+		l.mu.Lock()
+		sessions := l.sessions
+		l.sessions = make(map[string]*PacketSession)
+		l.mu.Unlock()
+		for _, s := range sessions {
+			s.stop()
+		}
+	drain:
+		for {
+			select {
+			case s := <-l.accept:
+				s.stop()
+			default:
+				break drain
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the local address of the shared PacketConn.
+func (l *PacketListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// remove forgets s so later datagrams from its address start a new session.
+func (l *PacketListener) remove(s *PacketSession) {
+	l.mu.Lock()
+	if l.sessions[s.key] == s {
+		delete(l.sessions, s.key)
+	}
+	l.mu.Unlock()
+}
+
+// PacketSession is a virtual connection to a single remote address of a
+// PacketListener. Every Read returns one datagram; writes are sent through
+// the shared PacketConn of the listener.
+type PacketSession struct {
+	l      *PacketListener
+	remote net.Addr
+	key    string
+
+	mu     sync.Mutex
+	buffer BackPacketBuffer[net.Addr]
+	notify chan struct{}
+	idle   *time.Timer // started by Accept
+
+	readDeadline  deadline
+	writeDeadline deadline
+	done          chan struct{}
+	once          sync.Once
+}
+
+func newPacketSession(l *PacketListener, remote net.Addr, key string) *PacketSession {
+	s := &PacketSession{
+		l:             l,
+		remote:        remote,
+		key:           key,
+		buffer:        BackPacketBuffer[net.Addr]{Pool: l.pool, Limits: l.limits},
+		notify:        make(chan struct{}, 1),
+		readDeadline:  deadline{cancel: make(chan struct{})},
+		writeDeadline: deadline{cancel: make(chan struct{})},
+		done:          make(chan struct{}),
+	}
+	return s
+}
+
+// startIdle starts the idle timeout of the session once it is accepted.
+func (s *PacketSession) startIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	if s.l.idleTimeout > 0 && s.idle == nil {
+		s.idle = time.AfterFunc(s.l.idleTimeout, func() { _ = s.Close() })
+	}
+}
+
+// deliver queues a received datagram at the tail of the session buffer.
+func (s *PacketSession) deliver(buf []byte, addr net.Addr) {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		releaseBuffer(s.l.pool, buf)
+		return
+	default:
+	}
+	s.buffer.Append(buf, addr)
+	s.mu.Unlock()
+	s.touch()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// touch postpones the idle timeout of the session.
+func (s *PacketSession) touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.idle != nil {
+		s.idle.Reset(s.l.idleTimeout)
+	}
+}
+
+// PutBack pushes a copy of a datagram back so it will be returned by the
+// next Read; the caller keeps ownership of bytes. The session limits apply;
+// see BackPacketBuffer.PutBack.
+func (s *PacketSession) PutBack(bytes []byte) {
+	s.mu.Lock()
+	s.buffer.PutBackCopy(bytes, s.remote)
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Dropped returns the counters of datagrams the session gave up because of
+// its limits.
+func (s *PacketSession) Dropped() DropStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buffer.Dropped
+}
+
+// Read reads the next datagram of the session into p, blocking until one
+// arrives, the read deadline expires or the session is closed. Datagrams
+// larger than p are truncated.
+func (s *PacketSession) Read(p []byte) (n int, err error) {
+	for {
+		s.mu.Lock()
+		var ok bool
+		n, _, ok, err = s.buffer.TryReadFrom(p)
+		s.mu.Unlock()
+		if ok {
+			return
+		}
+		select {
+		case <-s.notify:
+		case <-s.done:
+			return 0, net.ErrClosed
+		case <-s.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Write sends p as a single datagram to the remote address of the session.
+// The write deadline of the session is checked before the datagram is sent.
+func (s *PacketSession) Write(p []byte) (n int, err error) {
+	select {
+	case <-s.done:
+		return 0, net.ErrClosed
+	case <-s.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+	s.touch()
+	return s.l.conn.WriteTo(p, s.remote)
+}
+
+// Close closes the session and releases its buffered datagrams. The shared
+// PacketConn stays open; datagrams arriving later from the same remote
+// address start a new session.
+func (s *PacketSession) Close() error {
+	s.l.remove(s)
+	s.stop()
+	return nil
+}
+
+// stop closes the session without touching the listener.
+func (s *PacketSession) stop() {
+	s.once.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		if s.idle != nil {
+			s.idle.Stop()
+		}
+		s.buffer.Wipe()
+		s.mu.Unlock()
+	})
+}
+
+// LocalAddr returns the local address of the shared PacketConn.
+func (s *PacketSession) LocalAddr() net.Addr {
+	return s.l.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the session.
+func (s *PacketSession) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+// SetDeadline sets the read and write deadlines of the session.
+func (s *PacketSession) SetDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for pending and future Read calls.
+func (s *PacketSession) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future Write calls. Writes go
+// through the shared PacketConn, so the deadline is enforced by the session
+// itself: once it has passed, Write fails with os.ErrDeadlineExceeded
+// without sending. A Write already handed to the PacketConn is not
+// interrupted.
+func (s *PacketSession) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// deadline is a resettable timer that closes a channel when it fires.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline is exceeded
+}
+
+// set arms the deadline for t. A zero t disables it.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish
+	}
+	d.timer = nil
+
+	closed := false
+	select {
+	case <-d.cancel:
+		closed = true
+	default:
+	}
+
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline is exceeded.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
@@ -0,0 +1,163 @@
+package putback_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/asciimoth/putback"
+)
+
+func acceptSession(t *testing.T, l net.Listener) net.Conn {
+	t.Helper()
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		c, err := l.Accept()
+		ch <- result{c, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatalf("accept: %v", r.err)
+		}
+		return r.c
+	case <-time.After(5 * time.Second):
+		t.Fatalf("accept timed out")
+	}
+	return nil
+}
+
+func TestPacketListener_Sessions(t *testing.T) {
+	server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	l := putback.NewPacketListener(server, 0, nil)
+	defer l.Close()
+
+	a := listenUDP(t)
+	b := listenUDP(t)
+	dst := server.LocalAddr().(*net.UDPAddr)
+	_, _ = a.WriteToUDP([]byte("from a"), dst)
+
+	sa := acceptSession(t, l)
+	if sa.RemoteAddr().String() != a.LocalAddr().String() {
+		t.Fatalf("unexpected remote %v", sa.RemoteAddr())
+	}
+	_, _ = b.WriteToUDP([]byte("from b"), dst)
+	_, _ = a.WriteToUDP([]byte("again a"), dst)
+	sb := acceptSession(t, l)
+	if sb.RemoteAddr().String() != b.LocalAddr().String() {
+		t.Fatalf("unexpected remote %v", sb.RemoteAddr())
+	}
+
+	p := make([]byte, 32)
+	for _, want := range []string{"from a", "again a"} {
+		_ = sa.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := sa.Read(p)
+		if err != nil || string(p[:n]) != want {
+			t.Fatalf("session a: %q %v, want %q", p[:n], err, want)
+		}
+	}
+	n, err := sb.Read(p)
+	if err != nil || string(p[:n]) != "from b" {
+		t.Fatalf("session b: %q %v", p[:n], err)
+	}
+
+	// Sniffed datagrams may be put back into the session.
+	sb.(*putback.PacketSession).PutBack([]byte("sniffed"))
+	n, _ = sb.Read(p)
+	if string(p[:n]) != "sniffed" {
+		t.Fatalf("put back: %q", p[:n])
+	}
+
+	if _, err := sb.Write([]byte("reply")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := b.ReadFromUDP(p)
+	if err != nil || !bytes.Equal(p[:n], []byte("reply")) || from.Port != dst.Port {
+		t.Fatalf("reply: %q from %v: %v", p[:n], from, err)
+	}
+
+	_ = sa.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := sa.Read(p); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	_ = sa.SetDeadline(time.Now().Add(-time.Second))
+	if _, err := sa.Write([]byte("late")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected write deadline error, got %v", err)
+	}
+	_ = sa.SetWriteDeadline(time.Time{})
+	if _, err := sa.Write([]byte("on time")); err != nil {
+		t.Fatalf("write after clearing deadline: %v", err)
+	}
+
+	_ = l.Close()
+	if _, err := sb.Read(p); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected closed session, got %v", err)
+	}
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected closed listener, got %v", err)
+	}
+}
+
+func TestPacketListener_IdleTimeout(t *testing.T) {
+	server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	l := putback.NewPacketListener(server, 50*time.Millisecond, nil)
+	defer l.Close()
+
+	a := listenUDP(t)
+	dst := server.LocalAddr().(*net.UDPAddr)
+	_, _ = a.WriteToUDP([]byte("first"), dst)
+	s := acceptSession(t, l)
+
+	p := make([]byte, 32)
+	_, _ = s.Read(p)
+	if _, err := s.Read(p); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected idle session to close, got %v", err)
+	}
+
+	_, _ = a.WriteToUDP([]byte("second"), dst)
+	s2 := acceptSession(t, l)
+	n, err := s2.Read(p)
+	if err != nil || string(p[:n]) != "second" {
+		t.Fatalf("new session: %q %v", p[:n], err)
+	}
+}
+
+func TestPacketListener_IdleTimeoutStartsAtAccept(t *testing.T) {
+	server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	const idle = 50 * time.Millisecond
+	l := putback.NewPacketListener(server, idle, nil)
+	defer l.Close()
+
+	a := listenUDP(t)
+	_, _ = a.WriteToUDP([]byte("first"), server.LocalAddr().(*net.UDPAddr))
+	// The session waits in the backlog for longer than the idle timeout.
+	time.Sleep(4 * idle)
+	s := acceptSession(t, l)
+
+	p := make([]byte, 32)
+	_ = s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := s.Read(p)
+	if err != nil || string(p[:n]) != "first" {
+		t.Fatalf("first datagram: %q %v", p[:n], err)
+	}
+	if _, err := s.Read(p); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected idle session to close, got %v", err)
+	}
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"net"
-	"slices"
-	"strings"
+	"time"
 
 	"github.com/asciimoth/putback"
 )
@@ -14,6 +14,8 @@ import (
 type Config struct {
 	Listen  string            // Addr to listen at
 	Mapping map[string]string // proto type -> proxy addr
+	// PROXY protocol version to announce clients to backends with; 0 to disable
+	ProxyProtocol int
 }
 
 func readConfig() Config {
@@ -21,6 +23,8 @@ func readConfig() Config {
 	httpProxy := flag.String("http", "127.0.0.1:80", "http proxying addr")
 	sshProxy := flag.String("ssh", "127.0.0.1:22", "http proxying addr")
 	socksProxy := flag.String("socks", "127.0.0.1:1080", "http proxying addr")
+	grpcProxy := flag.String("grpc", "127.0.0.1:50051", "h2c gRPC proxying addr")
+	proxyProtocol := flag.Int("proxy-protocol", 0, "PROXY protocol version to send to backends (0 disables)")
 
 	flag.Parse()
 
@@ -30,62 +34,36 @@ func readConfig() Config {
 			"http":  *httpProxy,
 			"ssh":   *sshProxy,
 			"socks": *socksProxy,
+			"grpc":  *grpcProxy,
 		},
+		ProxyProtocol: *proxyProtocol,
 	}
 	return cfg
 }
 
-// accept accepts incoming connection and reads 3-byte header from it.
-func accept(l net.Listener) (c net.Conn, h [3]byte) {
-	var err error
-	for {
-		c, err = l.Accept()
-		if err != nil {
-			// This is a simple example so we can just panic
-			panic(err)
-		}
+// routes lists protocol names in the order their matchers are consulted.
+// gRPC is checked before the generic HTTP route, which also accepts h2c.
+var routes = []string{"grpc", "http", "ssh", "socks"}
 
-		_, err = io.ReadFull(c, h[:])
-		if err != nil {
-			_ = c.Close()
-			continue
-		}
-
-		return
-	}
+// matchers maps protocol names to the matchers that detect them.
+var matchers = map[string]putback.Matcher{
+	"grpc":  putback.GRPC(),
+	"http":  putback.Or(putback.HTTP1(), putback.Prefix(putback.HTTP2Preface)),
+	"ssh":   putback.SSH(),
+	"socks": putback.SOCKS(),
 }
 
-// guessProto guesses protocol based on 3-byte header
-func guessProto(h [3]byte) string {
-	if h[0] == 4 || h[0] == 5 {
-		fmt.Println("socks protocol with header:", h)
-		return "socks"
-	}
-
-	str := string(h[:])
-	lower := strings.ToLower(str)
-
-	if lower == "ssh" {
-		fmt.Println("ssh protocol with header:", str)
-		return "ssh"
-	}
-
-	if slices.Contains([]string{
-		"get", "head", "post", "put", "delete",
-		"connect", "options", "trace", "patch",
-		"pri", "http",
-	}, lower) {
-		fmt.Println("http protocol with header:", str)
-		return "http"
+// proxy dialing outgoing connection to addr and copy all bytes between it and in.
+// If version is not 0, a PROXY protocol header announcing the client is sent first.
+func proxy(addr string, in net.Conn, version int) {
+	var out net.Conn
+	var err error
+	if version != 0 {
+		h := putback.NewProxyHeader(version, in)
+		out, err = putback.DialProxy(context.Background(), nil, "tcp", addr, h, in)
+	} else {
+		out, err = net.Dial("tcp", addr)
 	}
-
-	fmt.Println("unknown protocol with header:", h)
-	return "unknown"
-}
-
-// proxy dialing outgoing connection to addr and copy all bytes between it and in
-func proxy(addr string, in net.Conn) {
-	out, err := net.Dial("tcp", addr)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -102,6 +80,18 @@ func proxy(addr string, in net.Conn) {
 	}()
 }
 
+// serve proxies every connection accepted from l to addr.
+func serve(l net.Listener, proto, addr string, version int) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		fmt.Printf("%s protocol from %s; proxying to %s\n", proto, c.RemoteAddr(), addr)
+		proxy(addr, c, version)
+	}
+}
+
 func main() {
 	cfg := readConfig()
 
@@ -112,22 +102,20 @@ func main() {
 
 	fmt.Println("listening at", cfg.Listen)
 
-	for {
-		c, header := accept(l)
-
-		proto := guessProto(header)
-
-		addr, ok := cfg.Mapping[proto]
-		if !ok {
-			fmt.Printf("there is no mapped addr for %s protocol; dropping\n", proto)
-			_ = c.Close()
-			continue
-		}
-		fmt.Println("proxying to", addr)
-
-		// Putting header bytes back to conn
-		c = putback.WrapConn(c, header[:], nil)
+	// Mux peeks the header of every connection and puts it back before
+	// handing the connection to the matching route.
+	mux := putback.NewMux(l)
+	mux.SniffTimeout = 10 * time.Second
+	mux.ErrorHandler = func(c net.Conn, err error) {
+		fmt.Printf("dropping connection from %s: %v\n", c.RemoteAddr(), err)
+		_ = c.Close()
+	}
 
-		proxy(addr, c)
+	for _, proto := range routes {
+		addr := cfg.Mapping[proto]
+		go serve(mux.Match(matchers[proto]), proto, addr, cfg.ProxyProtocol)
 	}
+
+	// This is a simple example so we can just panic
+	panic(mux.Serve())
 }
@@ -0,0 +1,153 @@
+package putback
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// isGREASE reports whether v is one of the reserved GREASE values of
+// RFC 8701 (0x0a0a, 0x1a1a, ..., 0xfafa).
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// withoutGREASE returns vs without GREASE values.
+func withoutGREASE(vs []uint16) []uint16 {
+	return slices.DeleteFunc(slices.Clone(vs), isGREASE)
+}
+
+// joinUint16 formats vs with format and joins them with sep.
+func joinUint16(vs []uint16, format, sep string) string {
+	parts := make([]string, len(vs))
+	for i, v := range vs {
+		parts[i] = fmt.Sprintf(format, v)
+	}
+	return strings.Join(parts, sep)
+}
+
+// JA3String returns the JA3 fingerprint string of the ClientHello:
+// SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats as
+// dash-separated decimal lists, with GREASE values removed.
+func (h *ClientHello) JA3String() string {
+	formats := make([]uint16, len(h.ECPointFormats))
+	for i, f := range h.ECPointFormats {
+		formats[i] = uint16(f)
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		joinUint16(withoutGREASE(h.CipherSuites), "%d", "-"),
+		joinUint16(withoutGREASE(h.Extensions), "%d", "-"),
+		joinUint16(withoutGREASE(h.SupportedGroups), "%d", "-"),
+		joinUint16(formats, "%d", "-"),
+	}, ",")
+}
+
+// JA3 returns the JA3 fingerprint of the ClientHello: the MD5 hash of
+// JA3String in hex.
+func (h *ClientHello) JA3() string {
+	sum := md5.Sum([]byte(h.JA3String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello as sniffed from a TCP
+// stream, for example t13d1516h2_8daaf6152771_e5627efa2ab1.
+func (h *ClientHello) JA4() string {
+	a, b, c := h.ja4Parts()
+	return a + "_" + ja4Hash(b) + "_" + ja4Hash(c)
+}
+
+// JA4R returns the raw form of the JA4 fingerprint, with the sorted cipher
+// and extension lists in place of their hashes.
+func (h *ClientHello) JA4R() string {
+	a, b, c := h.ja4Parts()
+	return a + "_" + b + "_" + c
+}
+
+// ja4Parts returns the JA4_a section and the unhashed JA4_b and JA4_c
+// sections.
+func (h *ClientHello) ja4Parts() (a, b, c string) {
+	ciphers := withoutGREASE(h.CipherSuites)
+	exts := withoutGREASE(h.Extensions)
+
+	version := h.Version
+	if versions := withoutGREASE(h.SupportedVersions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+	sni := "i"
+	if slices.Contains(exts, extServerName) {
+		sni = "d"
+	}
+	a = fmt.Sprintf("t%s%s%02d%02d%s",
+		ja4Version(version), sni, min(len(ciphers), 99), min(len(exts), 99), h.ja4ALPN())
+
+	slices.Sort(ciphers)
+	b = joinUint16(ciphers, "%04x", ",")
+
+	exts = slices.DeleteFunc(exts, func(e uint16) bool {
+		return e == extServerName || e == extALPN
+	})
+	slices.Sort(exts)
+	c = joinUint16(exts, "%04x", ",")
+	if algs := withoutGREASE(h.SignatureAlgorithms); len(algs) > 0 {
+		c += "_" + joinUint16(algs, "%04x", ",")
+	}
+	return a, b, c
+}
+
+// ja4Hash returns the first 12 hex digits of the SHA-256 of s, or twelve
+// zeros for an empty list.
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// ja4Version returns the two character JA4 code of a TLS version.
+func ja4Version(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	case 0xfeff:
+		return "d1"
+	case 0xfefd:
+		return "d2"
+	case 0xfefc:
+		return "d3"
+	}
+	return "00"
+}
+
+// ja4ALPN returns the first and last character of the first ALPN protocol,
+// falling back to its hex form when either is not alphanumeric.
+func (h *ClientHello) ja4ALPN() string {
+	if len(h.ALPNProtocols) == 0 || h.ALPNProtocols[0] == "" {
+		return "00"
+	}
+	p := h.ALPNProtocols[0]
+	if isAlnum(p[0]) && isAlnum(p[len(p)-1]) {
+		return string([]byte{p[0], p[len(p)-1]})
+	}
+	x := hex.EncodeToString([]byte(p))
+	return string([]byte{x[0], x[len(x)-1]})
+}
+
+func isAlnum(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
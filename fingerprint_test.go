@@ -0,0 +1,91 @@
+package putback_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/asciimoth/putback"
+)
+
+// readGolden parses a "key value" per line golden file.
+func readGolden(t *testing.T, path string) map[string]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open golden: %v", err)
+	}
+	defer f.Close()
+	golden := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		key, value, _ := strings.Cut(sc.Text(), " ")
+		golden[key] = value
+	}
+	return golden
+}
+
+func TestClientHello_Fingerprints(t *testing.T) {
+	for _, name := range []string{"chrome_grease", "go_crypto_tls"} {
+		t.Run(name, func(t *testing.T) {
+			capture := filepath.Join("testdata", "clienthello", name)
+			record, err := os.ReadFile(capture + ".bin")
+			if err != nil {
+				t.Fatalf("read capture: %v", err)
+			}
+			golden := readGolden(t, capture+".golden")
+
+			r := &putback.PutBackReader{Reader: bytes.NewReader(record)}
+			hello, err := putback.ReadClientHello(r)
+			if err != nil {
+				t.Fatalf("read ClientHello: %v", err)
+			}
+			got := map[string]string{
+				"ja3":      hello.JA3String(),
+				"ja3_hash": hello.JA3(),
+				"ja4":      hello.JA4(),
+				"ja4_r":    hello.JA4R(),
+			}
+			for key := range got {
+				if _, ok := golden[key]; !ok {
+					t.Errorf("golden file has no %s", key)
+				}
+			}
+			for key, want := range golden {
+				if got[key] != want {
+					t.Errorf("%s:\n got %s\nwant %s", key, got[key], want)
+				}
+			}
+		})
+	}
+}
+
+func TestSniffTLS_Metadata(t *testing.T) {
+	record, err := os.ReadFile("testdata/clienthello/chrome_grease.bin")
+	if err != nil {
+		t.Fatalf("read capture: %v", err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() { _, _ = client.Write(record) }()
+
+	conn, hello, err := putback.SniffTLS(server, nil)
+	if err != nil {
+		t.Fatalf("sniff: %v", err)
+	}
+	defer conn.Close()
+	meta := conn.(putback.WithMetadata).Metadata()
+	if meta.ClientHello != hello || meta.JA4 != "t13d1516h2_8daaf6152771_e5627efa2ab1" ||
+		meta.JA3 != "cd08e31494f9531f560d64c695473da9" {
+		t.Fatalf("unexpected metadata %+v", meta)
+	}
+	got := make([]byte, len(record))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, record) {
+		t.Fatalf("sniffed bytes not replayed: %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package putback
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// sniffLen is the number of bytes http.DetectContentType considers.
+const sniffLen = 512
+
+// FormatFamily groups formats by what they hold.
+type FormatFamily string
+
+const (
+	FamilyUnknown     FormatFamily = ""
+	FamilyCompression FormatFamily = "compression"
+	FamilyArchive     FormatFamily = "archive"
+	FamilyImage       FormatFamily = "image"
+	FamilyMedia       FormatFamily = "media"
+	FamilyDocument    FormatFamily = "document"
+	FamilyExecutable  FormatFamily = "executable"
+	FamilyText        FormatFamily = "text"
+	FamilyData        FormatFamily = "data"
+)
+
+// Format is a detected file format.
+type Format struct {
+	// Name is a short name such as "gzip". It is empty when the format
+	// was only recognized by http.DetectContentType.
+	Name   string
+	MIME   string
+	Family FormatFamily
+}
+
+// Signature recognizes a Format by the bytes at the start of a stream.
+type Signature struct {
+	Format Format
+	// Magic, if set, is matched at Offset.
+	Offset int
+	Magic  string
+	// Match, if set, is consulted once Magic matched. It gets the first Len
+	// bytes, or fewer if the stream is shorter.
+	Match func(peeked []byte) bool
+	Len   int
+}
+
+// need returns how many bytes the signature looks at.
+func (s *Signature) need() int {
+	if s.Match != nil {
+		return max(s.Len, s.Offset+len(s.Magic))
+	}
+	return s.Offset + len(s.Magic)
+}
+
+// test matches the signature against peeked. It answers NeedMore until
+// enough bytes are peeked to decide, unless final reports that the stream
+// has no more.
+func (s *Signature) test(peeked []byte, final bool) MatchResult {
+	if s.Magic != "" {
+		end := s.Offset + len(s.Magic)
+		n := min(len(peeked), end)
+		if n > s.Offset && string(peeked[s.Offset:n]) != s.Magic[:n-s.Offset] {
+			return NoMatch
+		}
+		if n < end {
+			if final {
+				return NoMatch
+			}
+			return NeedMore
+		}
+	}
+	if s.Match == nil {
+		return Match
+	}
+	if len(peeked) < s.Len && !final {
+		return NeedMore
+	}
+	if s.Match(peeked[:min(len(peeked), s.Len)]) {
+		return Match
+	}
+	return NoMatch
+}
+
+// DefaultSignatures is the signature table of DetectFormat. Earlier entries
+// take precedence.
+var DefaultSignatures = []Signature{
+	{Format: Format{"gzip", "application/gzip", FamilyCompression}, Magic: "\x1f\x8b"},
+	{Format: Format{"zstd", "application/zstd", FamilyCompression}, Magic: "\x28\xb5\x2f\xfd"},
+	{Format: Format{"xz", "application/x-xz", FamilyCompression}, Magic: "\xfd7zXZ\x00"},
+	{Format: Format{"bzip2", "application/x-bzip2", FamilyCompression}, Magic: "BZh"},
+	{Format: Format{"lz4", "application/x-lz4", FamilyCompression}, Magic: "\x04\x22\x4d\x18"},
+	{Format: Format{"zip", "application/zip", FamilyArchive}, Magic: "PK\x03\x04"},
+	{Format: Format{"zip", "application/zip", FamilyArchive}, Magic: "PK\x05\x06"},
+	{Format: Format{"7z", "application/x-7z-compressed", FamilyArchive}, Magic: "7z\xbc\xaf\x27\x1c"},
+	{Format: Format{"rar", "application/vnd.rar", FamilyArchive}, Magic: "Rar!\x1a\x07"},
+	{Format: Format{"png", "image/png", FamilyImage}, Magic: "\x89PNG\r\n\x1a\n"},
+	{Format: Format{"jpeg", "image/jpeg", FamilyImage}, Magic: "\xff\xd8\xff"},
+	{Format: Format{"gif", "image/gif", FamilyImage}, Magic: "GIF87a"},
+	{Format: Format{"gif", "image/gif", FamilyImage}, Magic: "GIF89a"},
+	{Format: Format{"webp", "image/webp", FamilyImage}, Magic: "RIFF", Len: 12, Match: func(p []byte) bool {
+		return len(p) >= 12 && string(p[8:12]) == "WEBP"
+	}},
+	// ISO base media files are told apart by the major brand after ftyp.
+	{Format: Format{"heic", "image/heic", FamilyImage}, Offset: 4, Magic: "ftypheic"},
+	{Format: Format{"heic", "image/heic", FamilyImage}, Offset: 4, Magic: "ftypheix"},
+	{Format: Format{"heif", "image/heif", FamilyImage}, Offset: 4, Magic: "ftypmif1"},
+	{Format: Format{"avif", "image/avif", FamilyImage}, Offset: 4, Magic: "ftypavif"},
+	{Format: Format{"avif", "image/avif", FamilyImage}, Offset: 4, Magic: "ftypavis"},
+	{Format: Format{"flac", "audio/flac", FamilyMedia}, Magic: "fLaC"},
+	{Format: Format{"ogg", "audio/ogg", FamilyMedia}, Magic: "OggS"},
+	{Format: Format{"mp4", "video/mp4", FamilyMedia}, Offset: 4, Magic: "ftypisom"},
+	{Format: Format{"mp4", "video/mp4", FamilyMedia}, Offset: 4, Magic: "ftypiso2"},
+	{Format: Format{"mp4", "video/mp4", FamilyMedia}, Offset: 4, Magic: "ftypmp41"},
+	{Format: Format{"mp4", "video/mp4", FamilyMedia}, Offset: 4, Magic: "ftypmp42"},
+	{Format: Format{"mp4", "video/mp4", FamilyMedia}, Offset: 4, Magic: "ftypavc1"},
+	{Format: Format{"mp4", "video/mp4", FamilyMedia}, Offset: 4, Magic: "ftypdash"},
+	{Format: Format{"m4v", "video/x-m4v", FamilyMedia}, Offset: 4, Magic: "ftypM4V "},
+	{Format: Format{"m4a", "audio/mp4", FamilyMedia}, Offset: 4, Magic: "ftypM4A "},
+	{Format: Format{"mov", "video/quicktime", FamilyMedia}, Offset: 4, Magic: "ftypqt  "},
+	{Format: Format{"3gp", "video/3gpp", FamilyMedia}, Offset: 4, Magic: "ftyp3gp"},
+	{Format: Format{"3g2", "video/3gpp2", FamilyMedia}, Offset: 4, Magic: "ftyp3g2"},
+	{Format: Format{"pdf", "application/pdf", FamilyDocument}, Magic: "%PDF-"},
+	{Format: Format{"elf", "application/x-elf", FamilyExecutable}, Magic: "\x7fELF"},
+	{Format: Format{"pe", "application/vnd.microsoft.portable-executable", FamilyExecutable}, Magic: "MZ", Len: sniffLen, Match: isPE},
+	{Format: Format{"msdos", "application/x-dosexec", FamilyExecutable}, Magic: "MZ"},
+	{Format: Format{"wasm", "application/wasm", FamilyExecutable}, Magic: "\x00asm"},
+	{Format: Format{"sqlite", "application/vnd.sqlite3", FamilyData}, Magic: "SQLite format 3\x00"},
+	// tar comes late, so its magic at 257 does not hold back the others.
+	{Format: Format{"tar", "application/x-tar", FamilyArchive}, Offset: 257, Magic: "ustar"},
+	{Format: Format{"json", "application/json", FamilyText}, Len: sniffLen, Match: looksLikeJSON},
+}
+
+// isPE reports whether the MZ header p starts with points, through e_lfanew,
+// at a PE signature within p.
+func isPE(p []byte) bool {
+	if len(p) < 0x40 {
+		return false
+	}
+	off := int64(binary.LittleEndian.Uint32(p[0x3c:]))
+	return off+4 <= int64(len(p)) && string(p[off:off+4]) == "PE\x00\x00"
+}
+
+// looksLikeJSON reports whether p starts a JSON object or array that is
+// valid as far as it goes.
+func looksLikeJSON(p []byte) bool {
+	p = bytes.TrimPrefix(p, []byte("\xef\xbb\xbf"))
+	dec := json.NewDecoder(bytes.NewReader(p))
+	tok, err := dec.Token()
+	if err != nil || (tok != json.Delim('{') && tok != json.Delim('[')) {
+		return false
+	}
+	for {
+		if _, err := dec.Token(); err != nil {
+			return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+// FormatDetector detects file formats with a signature table.
+type FormatDetector struct {
+	// Signatures is consulted in order; the first match wins. Extend it
+	// with DefaultSignatures to add formats.
+	Signatures []Signature
+}
+
+// Detect peeks from r until a signature matches, once every signature that
+// takes precedence has ruled the stream out, and reports the format of the
+// stream. Streams no signature matches are classified by
+// http.DetectContentType, which considers up to 512 bytes. The returned
+// reader replays every peeked byte followed by the rest of r; it is r itself
+// if r already supports put-back. If reading r fails before the format is
+// decided, the format is detected from the bytes peeked so far and the
+// returned reader replays them and then returns the error; a stream ending
+// early is not an error.
+func (d *FormatDetector) Detect(r io.Reader) (Format, io.Reader) {
+	pb, ok := r.(PutBacker)
+	if !ok {
+		pb = &PutBackReader{Reader: r}
+	}
+	n := sniffLen
+	for i := range d.Signatures {
+		n = max(n, d.Signatures[i].need())
+	}
+	var sig *Signature
+	peeked, err := PeekUntil(pb, n, func(p []byte) bool {
+		var ok bool
+		sig, ok = d.decide(p, false)
+		return ok
+	})
+	var replay io.Reader = pb
+	if err != nil {
+		sig, _ = d.decide(peeked, true)
+		if !errors.Is(err, ErrPeekLimit) && !errors.Is(err, io.EOF) {
+			replay = io.MultiReader(io.LimitReader(pb, int64(len(peeked))), &failedReader{err})
+		}
+	}
+	if sig != nil {
+		return sig.Format, replay
+	}
+	return contentTypeFormat(http.DetectContentType(peeked)), replay
+}
+
+// failedReader returns the error that ended a stream.
+type failedReader struct {
+	err error
+}
+
+func (r *failedReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// decide returns the first signature that matches peeked, or nil if none
+// does. ok is false while a signature that takes precedence cannot tell yet,
+// or while no signature matched and http.DetectContentType could look at
+// more bytes. When final is set the stream has no more bytes, so a decision
+// is always made.
+func (d *FormatDetector) decide(peeked []byte, final bool) (sig *Signature, ok bool) {
+	for i := range d.Signatures {
+		switch d.Signatures[i].test(peeked, final) {
+		case Match:
+			return &d.Signatures[i], true
+		case NeedMore:
+			return nil, false
+		}
+	}
+	return nil, final || len(peeked) >= sniffLen
+}
+
+// contentTypeFormat returns the Format of a MIME type found by
+// http.DetectContentType.
+func contentTypeFormat(contentType string) Format {
+	f := Format{MIME: contentType}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return f
+	}
+	top, sub, _ := strings.Cut(mediaType, "/")
+	switch {
+	case top == "image":
+		f.Family = FamilyImage
+	case top == "audio" || top == "video":
+		f.Family = FamilyMedia
+	case top == "text" || strings.HasSuffix(sub, "+xml") || sub == "json":
+		f.Family = FamilyText
+	case top == "font":
+		f.Family = FamilyData
+	case mediaType == "application/pdf" || mediaType == "application/postscript":
+		f.Family = FamilyDocument
+	case mediaType == "application/zip" || mediaType == "application/x-rar-compressed":
+		f.Family = FamilyArchive
+	case mediaType == "application/x-gzip":
+		f.Family = FamilyCompression
+	case mediaType == "application/wasm":
+		f.Family = FamilyExecutable
+	}
+	return f
+}
+
+// DetectFormat detects the format of r with DefaultSignatures. See
+// FormatDetector.Detect.
+func DetectFormat(r io.Reader) (Format, io.Reader) {
+	d := FormatDetector{Signatures: DefaultSignatures}
+	return d.Detect(r)
+}
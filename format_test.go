@@ -0,0 +1,165 @@
+package putback_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/asciimoth/putback"
+)
+
+func gzipData(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, _ = zw.Write([]byte("hello"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarData(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "a.txt", Mode: 0o644, Size: 5}); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = tw.Write([]byte("hello"))
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipData(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create("a.txt")
+	_, _ = w.Write([]byte("hello"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func pngData(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// peData returns an MZ header whose e_lfanew is lfanew, followed by a PE
+// signature at 0x80.
+func peData(lfanew uint32) []byte {
+	p := make([]byte, 0x100)
+	copy(p, "MZ")
+	binary.LittleEndian.PutUint32(p[0x3c:], lfanew)
+	copy(p[0x80:], "PE\x00\x00")
+	return p
+}
+
+func TestDetectFormat(t *testing.T) {
+	for _, tc := range []struct {
+		data   []byte
+		name   string
+		mime   string
+		family putback.FormatFamily
+	}{
+		{gzipData(t), "gzip", "application/gzip", putback.FamilyCompression},
+		{tarData(t), "tar", "application/x-tar", putback.FamilyArchive},
+		{zipData(t), "zip", "application/zip", putback.FamilyArchive},
+		{pngData(t), "png", "image/png", putback.FamilyImage},
+		{[]byte("\x28\xb5\x2f\xfd\x00"), "zstd", "application/zstd", putback.FamilyCompression},
+		{[]byte("\x7fELF\x02\x01\x01"), "elf", "application/x-elf", putback.FamilyExecutable},
+		{[]byte("%PDF-1.7\n"), "pdf", "application/pdf", putback.FamilyDocument},
+		{[]byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isomiso2"), "mp4", "video/mp4", putback.FamilyMedia},
+		{[]byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), "heic", "image/heic", putback.FamilyImage},
+		{[]byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1"), "avif", "image/avif", putback.FamilyImage},
+		{[]byte("\x00\x00\x00\x14ftypqt  \x20\x05\x03\x00qt  "), "mov", "video/quicktime", putback.FamilyMedia},
+		{[]byte("\x00\x00\x00\x18ftyp3gp5\x00\x00\x02\x003gp5isom"), "3gp", "video/3gpp", putback.FamilyMedia},
+		{peData(0x80), "pe", "application/vnd.microsoft.portable-executable", putback.FamilyExecutable},
+		{peData(0), "msdos", "application/x-dosexec", putback.FamilyExecutable},
+		{[]byte("  \n{\"key\": [1, 2, {\"nested\": true}], \"more\": "), "json", "application/json", putback.FamilyText},
+		{[]byte(`[1, 2, 3]`), "json", "application/json", putback.FamilyText},
+		{[]byte("{not json"), "", "text/plain; charset=utf-8", putback.FamilyText},
+		{[]byte("<!DOCTYPE html><html></html>"), "", "text/html; charset=utf-8", putback.FamilyText},
+		{[]byte("\x00\x01\x02\x03binary"), "", "application/octet-stream", putback.FamilyUnknown},
+		{nil, "", "text/plain; charset=utf-8", putback.FamilyText},
+	} {
+		f, r := putback.DetectFormat(iotest.HalfReader(bytes.NewReader(tc.data)))
+		if f.Name != tc.name || f.MIME != tc.mime || f.Family != tc.family {
+			t.Errorf("DetectFormat(%.16q) = %+v, want %s %s %s", tc.data, f, tc.name, tc.mime, tc.family)
+		}
+		if all, _ := io.ReadAll(r); !bytes.Equal(all, tc.data) {
+			t.Errorf("DetectFormat(%.16q) did not replay the stream", tc.data)
+		}
+	}
+}
+
+func TestFormatDetector_Custom(t *testing.T) {
+	custom := putback.Signature{
+		Format: putback.Format{Name: "myproto", MIME: "application/x-myproto", Family: putback.FamilyData},
+		Offset: 600,
+		Magic:  "MAGIC",
+	}
+	d := putback.FormatDetector{Signatures: append([]putback.Signature{custom}, putback.DefaultSignatures...)}
+	data := strings.Repeat("\x00", 600) + "MAGIC" + "rest"
+	f, r := d.Detect(strings.NewReader(data))
+	if f.Name != "myproto" {
+		t.Fatalf("Detect = %+v", f)
+	}
+	if all, _ := io.ReadAll(r); string(all) != data {
+		t.Fatalf("stream not replayed")
+	}
+
+	// A put-back reader is reused as is.
+	pb := &putback.PutBackReader{Reader: bytes.NewReader(gzipData(t))}
+	if f, r := d.Detect(pb); f.Name != "gzip" || r != pb {
+		t.Fatalf("Detect = %+v, %T", f, r)
+	}
+}
+
+func TestDetectFormat_Live(t *testing.T) {
+	// A signature decides as soon as its bytes arrive, without waiting for
+	// more of a stream that is still open.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() { _, _ = pw.Write(gzipData(t)[:4]) }()
+	done := make(chan putback.Format, 1)
+	go func() {
+		f, _ := putback.DetectFormat(pr)
+		done <- f
+	}()
+	select {
+	case f := <-done:
+		if f.Name != "gzip" {
+			t.Fatalf("DetectFormat = %+v", f)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("DetectFormat blocked")
+	}
+
+	// Read errors surface through the returned reader once the peeked
+	// bytes are replayed, even if the stream would not repeat them.
+	errRead := errors.New("read failed")
+	r := io.MultiReader(strings.NewReader("%PDF"), iotest.ErrReader(errRead), strings.NewReader("more"))
+	f, replay := putback.DetectFormat(r)
+	if f.Name != "" {
+		t.Fatalf("DetectFormat = %+v", f)
+	}
+	if b, err := io.ReadAll(replay); string(b) != "%PDF" || !errors.Is(err, errRead) {
+		t.Fatalf("replayed %q, %v", b, err)
+	}
+}
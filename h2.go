@@ -0,0 +1,299 @@
+package putback
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// HTTP2Preface is the connection preface of HTTP/2 clients with prior
+// knowledge, including h2c.
+const HTTP2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// HTTP/2 frame types and flags used while sniffing.
+const (
+	h2FrameHeaders      = 0x1
+	h2FrameSettings     = 0x4
+	h2FrameContinuation = 0x9
+
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+	h2FlagPriority   = 0x20
+
+	h2FrameHeaderLen = 9
+)
+
+var (
+	// ErrNotHTTP2 is returned when a stream does not start with the HTTP/2
+	// connection preface.
+	ErrNotHTTP2 = errors.New("putback: not an HTTP/2 connection preface")
+	// ErrMalformedHTTP2 is returned when the frames after the preface
+	// cannot be parsed.
+	ErrMalformedHTTP2 = errors.New("putback: malformed HTTP/2 frames")
+
+	errH2Incomplete = errors.New("putback: incomplete HTTP/2 request")
+)
+
+// HTTP2Setting is a parameter of a SETTINGS frame.
+type HTTP2Setting struct {
+	ID    uint16
+	Value uint32
+}
+
+// HTTP2Request is the first request of an HTTP/2 connection, decoded from
+// its first HEADERS frame.
+type HTTP2Request struct {
+	Settings  []HTTP2Setting // From the client's initial SETTINGS frame
+	StreamID  uint32
+	Method    string
+	Scheme    string
+	Authority string
+	Path      string
+	// Header holds the regular header fields under canonical keys.
+	Header http.Header
+}
+
+// ContentType returns the content-type header field.
+func (r *HTTP2Request) ContentType() string {
+	return r.Header.Get("Content-Type")
+}
+
+// IsGRPC reports whether the request is a gRPC call, recognized by its
+// content-type of application/grpc or a subtype such as
+// application/grpc+proto.
+func (r *HTTP2Request) IsGRPC() bool {
+	ct, _, _ := strings.Cut(r.ContentType(), ";")
+	ct = strings.ToLower(strings.TrimSpace(ct))
+	return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+")
+}
+
+// ReadHTTP2Request peeks the HTTP/2 connection preface, the client's
+// SETTINGS and the frames up to the end of the first request's header block
+// from r and decodes them. Nothing is consumed: every frame stays buffered
+// in r for the backend. If the header block does not end within limit
+// bytes, ErrRequestHeadTooLarge is returned. A limit of 0 means
+// DefaultMaxHeadBytes.
+func ReadHTTP2Request(r PutBacker, limit int) (*HTTP2Request, error) {
+	if limit <= 0 {
+		limit = DefaultMaxHeadBytes
+	}
+	var (
+		scan     h2Scanner
+		req      *HTTP2Request
+		parseErr error
+	)
+	_, err := PeekUntil(r, limit, func(p []byte) bool {
+		req, parseErr = scan.parse(p)
+		return parseErr != errH2Incomplete
+	})
+	switch {
+	case parseErr != nil && parseErr != errH2Incomplete:
+		return nil, parseErr
+	case errors.Is(err, ErrPeekLimit):
+		return nil, ErrRequestHeadTooLarge
+	case err != nil:
+		return nil, err
+	}
+	return req, nil
+}
+
+// h2Scanner parses the start of an HTTP/2 client stream, resuming where the
+// previous call stopped as more of the stream arrives.
+type h2Scanner struct {
+	pos    int           // bytes parsed so far
+	frames int           // frames parsed so far
+	req    *HTTP2Request // the request being parsed
+	block  []byte        // header block fragments seen so far
+	done   bool          // whether parsing ended
+	err    error         // why it failed, once done
+}
+
+// parse parses the start of an HTTP/2 client stream. It returns
+// errH2Incomplete if p ends before the first header block does. p must
+// extend the bytes passed to earlier calls.
+func (s *h2Scanner) parse(p []byte) (*HTTP2Request, error) {
+	if !s.done {
+		err := s.scan(p)
+		if err == errH2Incomplete {
+			return nil, err
+		}
+		s.done, s.err = true, err
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.req, nil
+}
+
+func (s *h2Scanner) scan(p []byte) error {
+	if s.req == nil {
+		n := min(len(p), len(HTTP2Preface))
+		if string(p[:n]) != HTTP2Preface[:n] {
+			return ErrNotHTTP2
+		}
+		if n < len(HTTP2Preface) {
+			return errH2Incomplete
+		}
+		s.pos = n
+		s.req = &HTTP2Request{Header: http.Header{}}
+	}
+
+	req := s.req
+	for {
+		q := p[s.pos:]
+		if len(q) < h2FrameHeaderLen {
+			return errH2Incomplete
+		}
+		length := int(q[0])<<16 | int(q[1])<<8 | int(q[2])
+		typ, flags := q[3], q[4]
+		stream := binary.BigEndian.Uint32(q[5:]) & 0x7fffffff
+		if len(q) < h2FrameHeaderLen+length {
+			return errH2Incomplete
+		}
+		payload := q[h2FrameHeaderLen : h2FrameHeaderLen+length]
+		s.pos += h2FrameHeaderLen + length
+		first := s.frames == 0
+		s.frames++
+
+		switch {
+		case first && typ != h2FrameSettings:
+			// The preface must be followed by SETTINGS (RFC 9113 3.4).
+			return ErrMalformedHTTP2
+		case s.block != nil && (typ != h2FrameContinuation || stream != req.StreamID):
+			// A header block must continue uninterrupted.
+			return ErrMalformedHTTP2
+		case typ == h2FrameSettings && flags&0x1 == 0:
+			if stream != 0 || length%6 != 0 {
+				return ErrMalformedHTTP2
+			}
+			for i := 0; i < length; i += 6 {
+				req.Settings = append(req.Settings, HTTP2Setting{
+					ID:    binary.BigEndian.Uint16(payload[i:]),
+					Value: binary.BigEndian.Uint32(payload[i+2:]),
+				})
+			}
+			continue
+		case typ == h2FrameHeaders:
+			if stream == 0 || stream%2 == 0 {
+				return ErrMalformedHTTP2
+			}
+			req.StreamID = stream
+			var ok bool
+			if payload, ok = headersFragment(payload, flags); !ok {
+				return ErrMalformedHTTP2
+			}
+			s.block = append([]byte{}, payload...)
+		case typ == h2FrameContinuation:
+			if s.block == nil {
+				return ErrMalformedHTTP2
+			}
+			s.block = append(s.block, payload...)
+		default:
+			// WINDOW_UPDATE, PRIORITY and the like may precede HEADERS.
+			continue
+		}
+		if flags&h2FlagEndHeaders != 0 {
+			break
+		}
+	}
+
+	fields, err := newHPACKDecoder().decode(s.block)
+	if err != nil {
+		return ErrMalformedHTTP2
+	}
+	for _, f := range fields {
+		switch f.Name {
+		case ":method":
+			req.Method = f.Value
+		case ":scheme":
+			req.Scheme = f.Value
+		case ":authority":
+			req.Authority = f.Value
+		case ":path":
+			req.Path = f.Value
+		default:
+			if strings.HasPrefix(f.Name, ":") {
+				return ErrMalformedHTTP2
+			}
+			req.Header.Add(http.CanonicalHeaderKey(f.Name), f.Value)
+		}
+	}
+	if req.Authority == "" {
+		req.Authority = req.Header.Get("Host")
+	}
+	return nil
+}
+
+// headersFragment strips padding and priority from a HEADERS payload.
+func headersFragment(payload []byte, flags byte) ([]byte, bool) {
+	pad := 0
+	if flags&h2FlagPadded != 0 {
+		if len(payload) < 1 {
+			return nil, false
+		}
+		pad = int(payload[0])
+		payload = payload[1:]
+	}
+	if flags&h2FlagPriority != 0 {
+		if len(payload) < 5 {
+			return nil, false
+		}
+		payload = payload[5:]
+	}
+	if pad > len(payload) {
+		return nil, false
+	}
+	return payload[:len(payload)-pad], true
+}
+
+// http2Matcher matches HTTP/2 streams whose first request satisfies a
+// function.
+type http2Matcher struct {
+	limit int
+	match func(*HTTP2Request) bool
+	scan  *h2Scanner // nil unless returned by ForConn
+}
+
+// HTTP2Head returns a Matcher for HTTP/2 streams with prior knowledge whose
+// first request, once its header block is complete within limit bytes,
+// satisfies match. Routing on it needs a Mux MaxPeek of at least limit. A
+// limit of 0 means 4096, the default Mux MaxPeek.
+func HTTP2Head(limit int, match func(*HTTP2Request) bool) Matcher {
+	if limit <= 0 {
+		limit = defaultMaxPeek
+	}
+	return &http2Matcher{limit: limit, match: match}
+}
+
+// GRPC returns a Matcher for gRPC calls over h2c with prior knowledge.
+func GRPC() Matcher {
+	return HTTP2Head(0, (*HTTP2Request).IsGRPC)
+}
+
+func (m *http2Matcher) Match(peeked []byte) MatchResult {
+	scan := m.scan
+	if scan == nil {
+		scan = new(h2Scanner)
+	}
+	req, err := scan.parse(peeked)
+	switch {
+	case err == errH2Incomplete && len(peeked) < m.limit:
+		return NeedMore
+	case err != nil || !m.match(req):
+		return NoMatch
+	}
+	return Match
+}
+
+func (m *http2Matcher) MinLen() int {
+	return len(HTTP2Preface)
+}
+
+// ForConn returns a copy of m that parses the frames of one connection
+// incrementally.
+func (m *http2Matcher) ForConn() Matcher {
+	c := *m
+	c.scan = new(h2Scanner)
+	return &c
+}
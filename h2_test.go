@@ -0,0 +1,175 @@
+package putback_test
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/asciimoth/putback"
+)
+
+func h2Frame(typ, flags byte, stream uint32, payload []byte) []byte {
+	f := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ, flags, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(f[5:], stream)
+	return append(f, payload...)
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestReadHTTP2Request_RFC7541(t *testing.T) {
+	// Requests C.4.1 to C.4.3 of RFC 7541 as one header block: Huffman
+	// coded literals that index into the dynamic table of earlier ones.
+	block := mustHex(t, "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff"+
+		"8286 84be 5886 a8eb 1064 9cbf"+
+		"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf")
+	// The first fragment is padded and carries a priority.
+	first := append([]byte{3, 0, 0, 0, 0, 16}, block[:10]...)
+	first = append(first, 0, 0, 0)
+	stream := []byte(putback.HTTP2Preface)
+	stream = append(stream, h2Frame(0x4, 0, 0, []byte{0, 4, 0, 1, 0, 0})...)
+	stream = append(stream, h2Frame(0x8, 0, 0, []byte{0, 0x0f, 0, 1})...)
+	stream = append(stream, h2Frame(0x1, 0x8|0x20, 1, first)...)
+	stream = append(stream, h2Frame(0x9, 0x4, 1, block[10:])...)
+	stream = append(stream, h2Frame(0x0, 0x1, 1, []byte("data"))...)
+
+	r := &putback.PutBackReader{Reader: iotest.OneByteReader(strings.NewReader(string(stream)))}
+	req, err := putback.ReadHTTP2Request(r, 0)
+	if err != nil {
+		t.Fatalf("ReadHTTP2Request: %v", err)
+	}
+	if req.Method != "GET" || req.Scheme != "https" || req.Path != "/index.html" ||
+		req.Authority != "www.example.com" || req.StreamID != 1 {
+		t.Fatalf("request = %+v", req)
+	}
+	if req.Header.Get("Cache-Control") != "no-cache" || req.Header.Get("Custom-Key") != "custom-value" {
+		t.Fatalf("header = %v", req.Header)
+	}
+	if len(req.Settings) != 1 || req.Settings[0] != (putback.HTTP2Setting{ID: 4, Value: 1 << 16}) {
+		t.Fatalf("settings = %v", req.Settings)
+	}
+	if all, _ := io.ReadAll(r); string(all) != string(stream) {
+		t.Fatalf("stream not intact")
+	}
+}
+
+func TestReadHTTP2Request_Errors(t *testing.T) {
+	settings := h2Frame(0x4, 0, 0, nil)
+	headers := h2Frame(0x1, 0x4, 1, []byte{0x82})
+	for name, tc := range map[string]struct {
+		data string
+		err  error
+	}{
+		"http1":           {"GET / HTTP/1.1\r\n\r\n" + strings.Repeat("x", 16), putback.ErrNotHTTP2},
+		"no settings":     {putback.HTTP2Preface + string(headers), putback.ErrMalformedHTTP2},
+		"even stream":     {putback.HTTP2Preface + string(settings) + string(h2Frame(0x1, 0x4, 2, []byte{0x82})), putback.ErrMalformedHTTP2},
+		"bad index":       {putback.HTTP2Preface + string(settings) + string(h2Frame(0x1, 0x4, 1, []byte{0xff, 0x7f})), putback.ErrMalformedHTTP2},
+		"interrupted":     {putback.HTTP2Preface + string(settings) + string(h2Frame(0x1, 0, 1, []byte{0x82})) + string(settings), putback.ErrMalformedHTTP2},
+		"truncated":       {putback.HTTP2Preface + string(settings), io.EOF},
+		"huffman padding": {putback.HTTP2Preface + string(settings) + string(h2Frame(0x1, 0x4, 1, []byte{0x40, 0x81, 0x00, 0x00})), putback.ErrMalformedHTTP2},
+	} {
+		r := &putback.PutBackReader{Reader: strings.NewReader(tc.data)}
+		if _, err := putback.ReadHTTP2Request(r, 0); !errors.Is(err, tc.err) {
+			t.Errorf("%s: err = %v, want %v", name, err, tc.err)
+		}
+	}
+}
+
+// captureH2C returns the bytes a prior-knowledge h2c client sends for req,
+// up to the end of its first header block.
+func captureH2C(t *testing.T, req *http.Request) *putback.HTTP2Request {
+	t.Helper()
+	client, server := net.Pipe()
+	tr := &http.Transport{
+		Protocols: new(http.Protocols),
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return client, nil
+		},
+	}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	defer tr.CloseIdleConnections()
+	go func() {
+		resp, err := tr.RoundTrip(req)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	conn := &putback.PutBackConn{Conn: server}
+	defer conn.Close()
+	h2req, err := putback.ReadHTTP2Request(conn, 0)
+	if err != nil {
+		t.Fatalf("ReadHTTP2Request: %v", err)
+	}
+	return h2req
+}
+
+func TestReadHTTP2Request_GRPC(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, "http://grpc.example:50051/pkg.Service/Method", strings.NewReader("\x00\x00\x00\x00\x00"))
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("Te", "trailers")
+	h2req := captureH2C(t, req)
+	if h2req.Method != "POST" || h2req.Authority != "grpc.example:50051" || h2req.Path != "/pkg.Service/Method" {
+		t.Fatalf("request = %+v", h2req)
+	}
+	if !h2req.IsGRPC() {
+		t.Fatalf("IsGRPC = false for %q", h2req.ContentType())
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "http://web.example/index.html", nil)
+	if h2req = captureH2C(t, req); h2req.IsGRPC() || h2req.Path != "/index.html" {
+		t.Fatalf("request = %+v", h2req)
+	}
+}
+
+func TestGRPC_Match(t *testing.T) {
+	settings := string(h2Frame(0x4, 0, 0, nil))
+	grpcHeaders := string(h2Frame(0x1, 0x4, 1, append([]byte{0x83, 0x84, 0x0f, 0x10, 16}, "application/grpc"...)))
+	stream := putback.HTTP2Preface + settings + grpcHeaders
+	m := putback.GRPC().(putback.ConnMatcher).ForConn()
+	for i := 1; i <= len(stream); i++ {
+		want := putback.NeedMore
+		if i == len(stream) {
+			want = putback.Match
+		}
+		if got := m.Match([]byte(stream[:i])); got != want {
+			t.Fatalf("Match of %d bytes = %v, want %v", i, got, want)
+		}
+	}
+
+	// The default limit is the default Mux MaxPeek.
+	large := putback.HTTP2Preface + string(h2Frame(0x4, 0, 0, make([]byte, 6*700)))
+	if got := putback.GRPC().Match([]byte(large[:4096])); got != putback.NoMatch {
+		t.Fatalf("Match at 4096 bytes = %v, want NoMatch", got)
+	}
+}
+
+func TestMux_RoutesGRPC(t *testing.T) {
+	m := newMux(t)
+	grpc := m.Match(putback.GRPC())
+	other := m.Match(putback.Prefix(putback.HTTP2Preface))
+	go func() { _ = m.Serve() }()
+
+	settings := string(h2Frame(0x4, 0, 0, nil))
+	// :method POST, :path /, content-type: application/grpc (literal, name
+	// from static index 31)
+	grpcHeaders := string(h2Frame(0x1, 0x4, 1, append([]byte{0x83, 0x84, 0x0f, 0x10, 16}, "application/grpc"...)))
+	plainHeaders := string(h2Frame(0x1, 0x4, 1, []byte{0x82, 0x84}))
+
+	dialAndWrite(t, m.Addr(), putback.HTTP2Preface, settings+plainHeaders)
+	expectRouted(t, other, putback.HTTP2Preface+settings+plainHeaders)
+	dialAndWrite(t, m.Addr(), putback.HTTP2Preface+settings, grpcHeaders)
+	expectRouted(t, grpc, putback.HTTP2Preface+settings+grpcHeaders)
+}
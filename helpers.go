@@ -16,6 +16,41 @@ func concatCopy[T any](a, b []T) []T {
 	return c
 }
 
+// maxDatagramSize is the size of buffers used to receive packets that are
+// read from the network on behalf of a peek.
+const maxDatagramSize = 64 * 1024
+
+// getBuffer returns a buffer of the given length from pool or allocates one.
+func getBuffer(pool BufferPool, length int) []byte {
+	if pool != nil {
+		return pool.GetBuffer(length)
+	}
+	return make([]byte, length)
+}
+
+// releaseBuffer returns buf to pool if pool is non-nil.
+func releaseBuffer(pool BufferPool, buf []byte) {
+	if pool != nil {
+		pool.PutBuffer(buf)
+	}
+}
+
+// readPacket receives a single packet using read into a buffer obtained from
+// pool. Without a pool the result is trimmed to a fresh slice so a large
+// receive buffer is not kept alive by a small packet.
+func readPacket[T any](pool BufferPool, read func([]byte) (int, T, error)) (buf []byte, assoc T, err error) {
+	buf = getBuffer(pool, maxDatagramSize)
+	n, assoc, err := read(buf)
+	if err != nil {
+		releaseBuffer(pool, buf)
+		return nil, assoc, err
+	}
+	if pool == nil {
+		return append([]byte{}, buf[:n]...), assoc, nil
+	}
+	return buf[:n], assoc, nil
+}
+
 func readJoin(a, b io.Reader, p []byte) (n int, err error) {
 	if a != nil {
 		n, err = a.Read(p)
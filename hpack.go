@@ -0,0 +1,231 @@
+package putback
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// HPACK limits. The dynamic table starts at the size HTTP/2 allows without
+// SETTINGS. The server may allow more in SETTINGS we do not see, so table
+// size updates are accepted up to hpackMaxTableSize. Decoded header lists
+// are capped to bound decompression.
+const (
+	hpackDefaultTableSize = 4096
+	hpackMaxTableSize     = 64 << 10
+	hpackMaxListSize      = 64 << 10
+)
+
+var errHPACK = errors.New("putback: malformed HPACK header block")
+
+// hpackField is a decoded header field.
+type hpackField struct {
+	Name, Value string
+}
+
+// size is the size of the field in the dynamic table (RFC 7541 4.1).
+func (f hpackField) size() int {
+	return len(f.Name) + len(f.Value) + 32
+}
+
+// hpackDecoder decodes HPACK header blocks (RFC 7541) of one connection
+// direction. It keeps the dynamic table across blocks.
+type hpackDecoder struct {
+	dynamic []hpackField // Newest entry first
+	size    int
+	maxSize int // Current table size limit
+}
+
+func newHPACKDecoder() *hpackDecoder {
+	return &hpackDecoder{maxSize: hpackDefaultTableSize}
+}
+
+// decode decodes a complete header block.
+func (d *hpackDecoder) decode(block []byte) ([]hpackField, error) {
+	var (
+		fields []hpackField
+		total  int
+	)
+	s := byteString(block)
+	for len(s) > 0 {
+		b := s[0]
+		var (
+			f   hpackField
+			err error
+		)
+		switch {
+		case b&0x80 != 0: // indexed field
+			var i uint64
+			if i, err = s.readHPACKInt(7); err == nil {
+				f, err = d.field(i)
+			}
+		case b&0xc0 == 0x40: // literal with incremental indexing
+			if f, err = d.literal(&s, 6); err == nil {
+				d.add(f)
+			}
+		case b&0xe0 == 0x20: // dynamic table size update
+			var n uint64
+			if n, err = s.readHPACKInt(5); err == nil {
+				if n > hpackMaxTableSize || len(fields) > 0 {
+					return nil, errHPACK
+				}
+				d.maxSize = int(n)
+				d.evict()
+			}
+			if err != nil {
+				return nil, err
+			}
+			continue
+		default: // literal without indexing or never indexed
+			f, err = d.literal(&s, 4)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if total += f.size(); total > hpackMaxListSize {
+			return nil, errHPACK
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// field returns the entry at index i of the combined static and dynamic
+// table.
+func (d *hpackDecoder) field(i uint64) (hpackField, error) {
+	switch {
+	case i == 0:
+		return hpackField{}, errHPACK
+	case i <= uint64(len(hpackStaticTable)):
+		return hpackStaticTable[i-1], nil
+	case i-uint64(len(hpackStaticTable)) <= uint64(len(d.dynamic)):
+		return d.dynamic[i-uint64(len(hpackStaticTable))-1], nil
+	}
+	return hpackField{}, errHPACK
+}
+
+// literal decodes a literal field whose name index has an n-bit prefix.
+func (d *hpackDecoder) literal(s *byteString, n uint8) (hpackField, error) {
+	i, err := s.readHPACKInt(n)
+	if err != nil {
+		return hpackField{}, err
+	}
+	var f hpackField
+	if i > 0 {
+		if f, err = d.field(i); err != nil {
+			return hpackField{}, err
+		}
+	} else if f.Name, err = s.readHPACKString(); err != nil {
+		return hpackField{}, err
+	}
+	f.Value, err = s.readHPACKString()
+	return f, err
+}
+
+// add inserts f into the dynamic table, evicting old entries to make room.
+func (d *hpackDecoder) add(f hpackField) {
+	d.dynamic = append([]hpackField{f}, d.dynamic...)
+	d.size += f.size()
+	d.evict()
+}
+
+func (d *hpackDecoder) evict() {
+	for d.size > d.maxSize {
+		last := len(d.dynamic) - 1
+		d.size -= d.dynamic[last].size()
+		d.dynamic = d.dynamic[:last]
+	}
+}
+
+// readHPACKInt reads an integer with an n-bit prefix (RFC 7541 5.1).
+func (s *byteString) readHPACKInt(n uint8) (uint64, error) {
+	if len(*s) == 0 {
+		return 0, errHPACK
+	}
+	limit := uint64(1)<<n - 1
+	i := uint64((*s)[0]) & limit
+	*s = (*s)[1:]
+	if i < limit {
+		return i, nil
+	}
+	for shift := 0; len(*s) > 0; shift += 7 {
+		if shift > 28 {
+			return 0, errHPACK
+		}
+		b := (*s)[0]
+		*s = (*s)[1:]
+		i += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return i, nil
+		}
+	}
+	return 0, errHPACK
+}
+
+// readHPACKString reads a string literal (RFC 7541 5.2).
+func (s *byteString) readHPACKString() (string, error) {
+	if len(*s) == 0 {
+		return "", errHPACK
+	}
+	huffman := (*s)[0]&0x80 != 0
+	n, err := s.readHPACKInt(7)
+	if err != nil || n > uint64(len(*s)) {
+		return "", errHPACK
+	}
+	raw := (*s)[:n]
+	*s = (*s)[n:]
+	if huffman {
+		return huffmanDecode(raw)
+	}
+	return string(raw), nil
+}
+
+// huffmanNode is a node of the HPACK Huffman decoding tree.
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      byte
+	leaf     bool
+}
+
+var huffmanTree = sync.OnceValue(func() *huffmanNode {
+	root := &huffmanNode{}
+	for sym, code := range huffmanCodes {
+		node := root
+		for bit := int(huffmanCodeLen[sym]) - 1; bit >= 0; bit-- {
+			b := code >> bit & 1
+			if node.children[b] == nil {
+				node.children[b] = &huffmanNode{}
+			}
+			node = node.children[b]
+		}
+		node.sym, node.leaf = byte(sym), true
+	}
+	return root
+})
+
+// huffmanDecode decodes a Huffman-encoded string. Padding must be a prefix
+// of the EOS code shorter than 8 bits; EOS itself is rejected.
+func huffmanDecode(p []byte) (string, error) {
+	root := huffmanTree()
+	var out strings.Builder
+	node, pad, ones := root, 0, true
+	for _, b := range p {
+		for bit := 7; bit >= 0; bit-- {
+			v := b >> bit & 1
+			if node = node.children[v]; node == nil {
+				return "", errHPACK
+			}
+			if node.leaf {
+				out.WriteByte(node.sym)
+				node, pad, ones = root, 0, true
+				continue
+			}
+			pad++
+			ones = ones && v == 1
+		}
+	}
+	if pad > 7 || !ones {
+		return "", errHPACK
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,74 @@
+package putback
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// WrapRequestBody replaces r.Body with a PutBackReadCloser around it and
+// returns it, so the body can be peeked while handlers further down still
+// read it completely. A body that is already a PutBackReadCloser is
+// returned as is. Limits of an http.MaxBytesReader body keep applying, as
+// every byte is still read from it once, and closing the returned reader
+// closes the original body.
+func WrapRequestBody(r *http.Request) *PutBackReadCloser {
+	if pb, ok := r.Body.(*PutBackReadCloser); ok {
+		return pb
+	}
+	body := r.Body
+	if body == nil {
+		body = http.NoBody
+	}
+	pb := &PutBackReadCloser{ReadCloser: body}
+	r.Body = pb
+	return pb
+}
+
+// PeekRequestBody returns up to the first n bytes of the body of r without
+// consuming them, wrapping the body with WrapRequestBody. Bodies shorter
+// than n are returned whole with a nil error.
+func PeekRequestBody(r *http.Request, n int) ([]byte, error) {
+	peeked, err := WrapRequestBody(r).Peek(n)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	return peeked, err
+}
+
+// PeekBody is a middleware that wraps every request body with
+// WrapRequestBody before calling next, so handlers can peek it cheaply with
+// PeekRequestBody or the Peek method of the body.
+func PeekBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WrapRequestBody(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SniffBody returns a handler that peeks up to the first n bytes of the
+// request body and serves the request with the handler pick returns for
+// them. The chosen handler reads the complete body. If pick returns nil,
+// the request is answered with 415 Unsupported Media Type. Bodies exceeding
+// an http.MaxBytesReader limit while peeking are answered with 413 Request
+// Entity Too Large, other read errors with 400 Bad Request.
+func SniffBody(n int, pick func(r *http.Request, peeked []byte) http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peeked, err := PeekRequestBody(r, n)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		h := pick(r, peeked)
+		if h == nil {
+			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,142 @@
+package putback_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/asciimoth/putback"
+)
+
+// echoBody answers with its name and the complete request body.
+func echoBody(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = io.WriteString(w, name+":"+string(body))
+	})
+}
+
+func post(t *testing.T, url, body string) (int, string) {
+	t.Helper()
+	resp, err := http.Post(url, "application/octet-stream", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	defer resp.Body.Close()
+	got, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(got)
+}
+
+func TestSniffBody(t *testing.T) {
+	handler := putback.SniffBody(2, func(r *http.Request, peeked []byte) http.Handler {
+		switch {
+		case string(peeked) == "\x1f\x8b":
+			return echoBody("gzip")
+		case strings.HasPrefix(string(peeked), "{"):
+			return echoBody("json")
+		}
+		return nil
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	for body, want := range map[string]string{
+		"\x1f\x8bcompressed": "gzip:\x1f\x8bcompressed",
+		`{"kind":"x"}`:       `json:{"kind":"x"}`,
+		"{":                  "json:{",
+	} {
+		if code, got := post(t, srv.URL, body); code != http.StatusOK || got != want {
+			t.Errorf("POST %q = %d %q, want %q", body, code, got, want)
+		}
+	}
+	if code, _ := post(t, srv.URL, "plain"); code != http.StatusUnsupportedMediaType {
+		t.Errorf("POST plain = %d", code)
+	}
+}
+
+func TestSniffBody_MaxBytes(t *testing.T) {
+	limited := func(n int64, next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			next.ServeHTTP(w, r)
+		})
+	}
+	pick := func(*http.Request, []byte) http.Handler { return echoBody("any") }
+
+	// Peeked bytes count against the limit once.
+	srv := httptest.NewServer(limited(10, putback.SniffBody(4, pick)))
+	defer srv.Close()
+	if code, got := post(t, srv.URL, "0123456789"); code != http.StatusOK || got != "any:0123456789" {
+		t.Errorf("POST at limit = %d %q", code, got)
+	}
+	if code, _ := post(t, srv.URL, "0123456789a"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST over limit = %d", code)
+	}
+
+	// Peeking past the limit fails early.
+	srv2 := httptest.NewServer(limited(2, putback.SniffBody(4, pick)))
+	defer srv2.Close()
+	if code, _ := post(t, srv2.URL, "0123456789"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST peeking over limit = %d", code)
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestWrapRequestBody(t *testing.T) {
+	body := &closeRecorder{Reader: strings.NewReader("payload")}
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Body = body
+
+	peeked, err := putback.PeekRequestBody(r, 3)
+	if err != nil || string(peeked) != "pay" {
+		t.Fatalf("PeekRequestBody = %q, %v", peeked, err)
+	}
+	if putback.WrapRequestBody(r) != r.Body {
+		t.Fatalf("WrapRequestBody wrapped twice")
+	}
+	// Bodies shorter than n are returned whole.
+	if peeked, err = putback.PeekRequestBody(r, 100); err != nil || string(peeked) != "payload" {
+		t.Fatalf("PeekRequestBody = %q, %v", peeked, err)
+	}
+	if got, _ := io.ReadAll(r.Body); string(got) != "payload" {
+		t.Fatalf("body = %q", got)
+	}
+	if err := r.Body.Close(); err != nil || !body.closed {
+		t.Fatalf("Close = %v, closed = %v", err, body.closed)
+	}
+}
+
+func TestPeekBody(t *testing.T) {
+	var peeked string
+	handler := putback.PeekBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := r.Body.(*putback.PutBackReadCloser).Peek(4)
+		peeked = string(b)
+		echoBody("full").ServeHTTP(w, r)
+	}))
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	if code, got := post(t, srv.URL, "magic body"); code != http.StatusOK || got != "full:magic body" || peeked != "magi" {
+		t.Fatalf("POST = %d %q, peeked %q", code, got, peeked)
+	}
+}
@@ -0,0 +1,258 @@
+package putback
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultMaxHeadBytes is the request head limit used when none is given,
+// matching http.DefaultMaxHeaderBytes.
+const DefaultMaxHeadBytes = http.DefaultMaxHeaderBytes
+
+var (
+	// ErrMalformedRequestHead is returned when an HTTP/1.x request head
+	// cannot be parsed.
+	ErrMalformedRequestHead = errors.New("putback: malformed HTTP request head")
+	// ErrRequestHeadTooLarge is returned when an HTTP/1.x request head does
+	// not end within the limit.
+	ErrRequestHeadTooLarge = errors.New("putback: HTTP request head too large")
+)
+
+// RequestHead is a parsed HTTP/1.x request line and header section.
+type RequestHead struct {
+	Method string
+	Target string   // The request-target as sent
+	URL    *url.URL // Target parsed like net/http does
+	Proto  string   // "HTTP/1.0" or "HTTP/1.1"
+	// Host is the authority of an absolute-form Target or the Host header.
+	Host string
+	// Header holds the header fields under canonical keys. Lines continued
+	// with obs-fold are joined with a single space.
+	Header http.Header
+	// Raw holds the head as received, up to and including the empty line
+	// that ends it. The message body or the next pipelined request follows.
+	Raw []byte
+}
+
+// ReadRequestHead peeks the first HTTP/1.x request head from r and parses
+// it. Nothing is consumed: every byte read, including the body and any
+// pipelined requests that followed the head, stays buffered in r. If the
+// head does not end within limit bytes, ErrRequestHeadTooLarge is returned.
+// A limit of 0 means DefaultMaxHeadBytes.
+func ReadRequestHead(r PutBacker, limit int) (*RequestHead, error) {
+	if limit <= 0 {
+		limit = DefaultMaxHeadBytes
+	}
+	var scan headScanner
+	peeked, err := PeekUntil(r, limit, func(p []byte) bool {
+		return scan.headLen(p) >= 0
+	})
+	switch {
+	case errors.Is(err, ErrPeekLimit):
+		return nil, ErrRequestHeadTooLarge
+	case err != nil:
+		return nil, err
+	}
+	return ParseRequestHead(peeked[:scan.headLen(peeked)])
+}
+
+// headScanner finds the end of the request head at the start of a stream,
+// resuming where the previous call stopped as more of the stream arrives.
+type headScanner struct {
+	line    int  // start of the line being scanned
+	next    int  // where to resume looking for the end of that line
+	started bool // whether a non-empty line was seen
+	end     int  // length of the head once found
+}
+
+// headLen returns the length of the request head p starts with, including
+// empty lines before the request line, or -1 if p does not contain a complete
+// head. p must extend the bytes passed to earlier calls. Lines may end with
+// CRLF or a bare LF.
+func (s *headScanner) headLen(p []byte) int {
+	for s.end == 0 {
+		i := bytes.IndexByte(p[s.next:], '\n')
+		if i < 0 {
+			s.next = len(p)
+			return -1
+		}
+		eol := s.next + i
+		line := bytes.TrimSuffix(p[s.line:eol], []byte("\r"))
+		s.line, s.next = eol+1, eol+1
+		if len(line) == 0 && s.started {
+			s.end = s.line
+		}
+		s.started = s.started || len(line) > 0
+	}
+	return s.end
+}
+
+// ParseRequestHead parses a complete HTTP/1.x request head, as found at the
+// start of a stream by ReadRequestHead.
+func ParseRequestHead(head []byte) (*RequestHead, error) {
+	lines := strings.Split(string(head), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	if len(lines) == 0 {
+		return nil, ErrMalformedRequestHead
+	}
+
+	h := &RequestHead{Header: http.Header{}, Raw: bytes.Clone(head)}
+	var ok bool
+	if h.Method, h.Target, h.Proto, ok = parseRequestLine(lines[0]); !ok {
+		return nil, ErrMalformedRequestHead
+	}
+
+	var last string // key of the last field, for obs-fold
+	for _, line := range lines[1:] {
+		if line == "" {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if last == "" {
+				return nil, ErrMalformedRequestHead
+			}
+			values := h.Header[last]
+			values[len(values)-1] = strings.TrimSpace(values[len(values)-1] + " " + strings.TrimSpace(line))
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found || !isToken(name) {
+			return nil, ErrMalformedRequestHead
+		}
+		last = http.CanonicalHeaderKey(name)
+		h.Header[last] = append(h.Header[last], strings.Trim(value, " \t"))
+	}
+
+	var err error
+	if h.Method == http.MethodConnect && !strings.HasPrefix(h.Target, "/") {
+		h.URL = &url.URL{Host: h.Target}
+	} else if h.URL, err = url.ParseRequestURI(h.Target); err != nil {
+		return nil, ErrMalformedRequestHead
+	}
+	if hosts := h.Header["Host"]; len(hosts) > 1 {
+		return nil, ErrMalformedRequestHead
+	}
+	h.Host = h.URL.Host
+	if h.Host == "" {
+		h.Host = h.Header.Get("Host")
+	}
+	return h, nil
+}
+
+func parseRequestLine(line string) (method, target, proto string, ok bool) {
+	method, rest, ok1 := strings.Cut(line, " ")
+	target, proto, ok2 := strings.Cut(rest, " ")
+	if !ok1 || !ok2 || !isToken(method) || target == "" || strings.ContainsAny(target, " \t") {
+		return "", "", "", false
+	}
+	major, _, ok := http.ParseHTTPVersion(proto)
+	if !ok || major != 1 {
+		return "", "", "", false
+	}
+	return method, target, proto, true
+}
+
+// isToken reports whether s is a non-empty RFC 9110 token.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Hostname returns Host without a port and with IPv6 brackets removed,
+// lowercased for comparisons.
+func (h *RequestHead) Hostname() string {
+	host := h.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+// headMatcher matches HTTP/1.x requests whose head satisfies a function.
+type headMatcher struct {
+	method Matcher
+	limit  int
+	match  func(*RequestHead) bool
+	scan   *headScanner // nil unless returned by ForConn
+}
+
+// HTTPHead returns a Matcher for HTTP/1.x requests whose head, once complete
+// within limit bytes, satisfies match. Routing on it needs a Mux MaxPeek of
+// at least limit. A limit of 0 means 4096, the default Mux MaxPeek.
+func HTTPHead(limit int, match func(*RequestHead) bool) Matcher {
+	if limit <= 0 {
+		limit = defaultMaxPeek
+	}
+	return &headMatcher{method: HTTP1(), limit: limit, match: match}
+}
+
+// HTTPHost returns a Matcher for HTTP/1.x requests for any of hosts,
+// compared case-insensitively and without port, within a head of 4096
+// bytes.
+func HTTPHost(hosts ...string) Matcher {
+	return HTTPHead(0, func(h *RequestHead) bool {
+		hostname := h.Hostname()
+		for _, host := range hosts {
+			if strings.EqualFold(hostname, host) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (m *headMatcher) Match(peeked []byte) MatchResult {
+	// Skip empty lines a client may send before the request line.
+	start := bytes.TrimLeft(peeked, "\r\n")
+	if len(start) > 0 && m.method.Match(start) == NoMatch {
+		return NoMatch
+	}
+	scan := m.scan
+	if scan == nil {
+		scan = new(headScanner)
+	}
+	n := scan.headLen(peeked)
+	if n < 0 {
+		if len(peeked) >= m.limit {
+			return NoMatch
+		}
+		return NeedMore
+	}
+	if n > m.limit {
+		return NoMatch
+	}
+	h, err := ParseRequestHead(peeked[:n])
+	if err != nil || !m.match(h) {
+		return NoMatch
+	}
+	return Match
+}
+
+func (m *headMatcher) MinLen() int {
+	return minLen(m.method)
+}
+
+// ForConn returns a copy of m that scans the head of one connection
+// incrementally.
+func (m *headMatcher) ForConn() Matcher {
+	c := *m
+	c.scan = new(headScanner)
+	return &c
+}
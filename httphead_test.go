@@ -0,0 +1,145 @@
+package putback_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/asciimoth/putback"
+)
+
+func TestReadRequestHead(t *testing.T) {
+	const head = "GET /api/v1?x=1 HTTP/1.1\r\n" +
+		"Host: Example.com:8080\r\n" +
+		"X-Folded: first\r\n" +
+		"  second\r\n" +
+		"\tthird\r\n" +
+		"Accept: a\r\n" +
+		"Accept: b\r\n" +
+		"\r\n"
+	// A pipelined second request follows the first one.
+	const next = "GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	r := &putback.PutBackReader{Reader: iotest.OneByteReader(strings.NewReader(head + next))}
+
+	h, err := putback.ReadRequestHead(r, 0)
+	if err != nil {
+		t.Fatalf("ReadRequestHead: %v", err)
+	}
+	if h.Method != "GET" || h.Target != "/api/v1?x=1" || h.Proto != "HTTP/1.1" {
+		t.Fatalf("request line = %q %q %q", h.Method, h.Target, h.Proto)
+	}
+	if h.URL.Path != "/api/v1" || h.URL.RawQuery != "x=1" {
+		t.Fatalf("URL = %v", h.URL)
+	}
+	if h.Host != "Example.com:8080" || h.Hostname() != "example.com" {
+		t.Fatalf("Host = %q, Hostname = %q", h.Host, h.Hostname())
+	}
+	if got := h.Header.Get("X-Folded"); got != "first second third" {
+		t.Fatalf("X-Folded = %q", got)
+	}
+	if got := h.Header.Values("Accept"); len(got) != 2 {
+		t.Fatalf("Accept = %q", got)
+	}
+	if string(h.Raw) != head {
+		t.Fatalf("Raw = %q", h.Raw)
+	}
+	all, _ := io.ReadAll(r)
+	if string(all) != head+next {
+		t.Fatalf("stream = %q", all)
+	}
+}
+
+func TestReadRequestHead_Pipelined(t *testing.T) {
+	const first = "\r\nGET /a HTTP/1.1\nHost: a\n\n"
+	const second = "GET http://b.example/b HTTP/1.1\r\nHost: ignored\r\n\r\n"
+	r := &putback.PutBackReader{Reader: strings.NewReader(first + second)}
+	h, err := putback.ReadRequestHead(r, 0)
+	if err != nil || h.Target != "/a" || h.Host != "a" || string(h.Raw) != first {
+		t.Fatalf("first = %+v, %v", h, err)
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(len(h.Raw))); err != nil {
+		t.Fatalf("discard: %v", err)
+	}
+	h, err = putback.ReadRequestHead(r, 0)
+	if err != nil || h.URL.Path != "/b" || h.Host != "b.example" {
+		t.Fatalf("second = %+v, %v", h, err)
+	}
+}
+
+func TestReadRequestHead_Errors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		data  string
+		limit int
+		err   error
+	}{
+		"too large":     {"GET / HTTP/1.1\r\nX: " + strings.Repeat("a", 100) + "\r\n\r\n", 64, putback.ErrRequestHeadTooLarge},
+		"bad version":   {"GET / HTTP/2.0\r\n\r\n", 0, putback.ErrMalformedRequestHead},
+		"space in name": {"GET / HTTP/1.1\r\nHost : a\r\n\r\n", 0, putback.ErrMalformedRequestHead},
+		"leading fold":  {"GET / HTTP/1.1\r\n folded\r\n\r\n", 0, putback.ErrMalformedRequestHead},
+		"two hosts":     {"GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n", 0, putback.ErrMalformedRequestHead},
+		"truncated":     {"GET / HTTP/1.1\r\nHost: a\r\n", 0, io.EOF},
+	} {
+		r := &putback.PutBackReader{Reader: strings.NewReader(tc.data)}
+		if _, err := putback.ReadRequestHead(r, tc.limit); !errors.Is(err, tc.err) {
+			t.Errorf("%s: err = %v, want %v", name, err, tc.err)
+		}
+		if all, _ := io.ReadAll(r); string(all) != tc.data {
+			t.Errorf("%s: stream = %q", name, all)
+		}
+	}
+}
+
+func TestHTTPHost(t *testing.T) {
+	m := putback.HTTPHost("example.com")
+	for _, tc := range []struct {
+		peeked string
+		want   putback.MatchResult
+	}{
+		{"GET / HTTP/1.1\r\nHost: a", putback.NeedMore},
+		{"GET / HTTP/1.1\r\nHost: EXAMPLE.com:80\r\n\r\n", putback.Match},
+		{"GET / HTTP/1.1\r\nHost: other.com\r\n\r\n", putback.NoMatch},
+		{"\x16\x03\x01", putback.NoMatch},
+	} {
+		if got := m.Match([]byte(tc.peeked)); got != tc.want {
+			t.Errorf("Match(%q) = %v, want %v", tc.peeked, got, tc.want)
+		}
+	}
+}
+
+func TestHTTPHost_Limit(t *testing.T) {
+	// The default limit is the default Mux MaxPeek, so a head that does not
+	// end within it is ruled out instead of waiting for bytes never peeked.
+	m := putback.HTTPHost("example.com")
+	head := "GET / HTTP/1.1\r\nX: " + strings.Repeat("a", 4096)
+	if got := m.Match([]byte(head[:4096])); got != putback.NoMatch {
+		t.Fatalf("Match at 4096 bytes = %v, want NoMatch", got)
+	}
+}
+
+func TestHTTPHost_ForConn(t *testing.T) {
+	head := "\r\nGET / HTTP/1.1\r\nHost: example.com\r\nX: 1\r\n\r\n"
+	m := putback.HTTPHost("example.com").(putback.ConnMatcher).ForConn()
+	for i := 1; i <= len(head); i++ {
+		want := putback.NeedMore
+		if i == len(head) {
+			want = putback.Match
+		}
+		if got := m.Match([]byte(head[:i])); got != want {
+			t.Fatalf("Match(%q) = %v, want %v", head[:i], got, want)
+		}
+	}
+}
+
+func TestMux_RoutesByHost(t *testing.T) {
+	m := newMux(t)
+	a := m.Match(putback.HTTPHost("a.example"))
+	b := m.Match(putback.HTTPHost("b.example"))
+	go func() { _ = m.Serve() }()
+
+	dialAndWrite(t, m.Addr(), "GET / HTTP/1.1\r\n", "Host: b.example\r\n\r\n")
+	expectRouted(t, b, "GET / HTTP/1.1\r\nHost: b.example\r\n\r\n")
+	dialAndWrite(t, m.Addr(), "GET / HTTP/1.1\r\nHost: a.example\r\n\r\n")
+	expectRouted(t, a, "GET / HTTP/1.1\r\nHost: a.example\r\n\r\n")
+}
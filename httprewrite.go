@@ -0,0 +1,434 @@
+package putback
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// RewriteMode selects which requests on a connection RequestRewriter
+// rewrites.
+type RewriteMode int
+
+const (
+	// RewriteFirst rewrites the first request head only and passes the
+	// rest of the stream through unchanged.
+	RewriteFirst RewriteMode = iota
+	// RewriteEach rewrites the head of every request on a keep-alive
+	// connection, following Content-Length and chunked message framing to
+	// find where each request ends.
+	RewriteEach
+)
+
+// maxChunkLine bounds chunk-size and trailer lines of chunked bodies.
+const maxChunkLine = 4096
+
+// hopByHop lists the hop-by-hop header fields of RFC 9110 and their common
+// legacy companions.
+var hopByHop = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// AppendBinary appends the head in HTTP/1.x wire format to b. The Host
+// header field is written first from Host, the other fields follow in
+// sorted key order. Target is written as is. ErrMalformedRequestHead is
+// returned if a field would not survive the trip, such as a Host with a line
+// break or a Proto other than HTTP/x.y.
+func (h *RequestHead) AppendBinary(b []byte) ([]byte, error) {
+	if !isToken(h.Method) || h.Target == "" || strings.ContainsAny(h.Target, " \r\n") ||
+		!isHTTPVersion(h.Proto) || !validHostHeader(h.Host) {
+		return b, ErrMalformedRequestHead
+	}
+	var buf bytes.Buffer
+	buf.Write(b)
+	fmt.Fprintf(&buf, "%s %s %s\r\n", h.Method, h.Target, h.Proto)
+	if h.Host != "" {
+		fmt.Fprintf(&buf, "Host: %s\r\n", h.Host)
+	}
+	if err := h.Header.WriteSubset(&buf, map[string]bool{"Host": true}); err != nil {
+		return b, err
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes(), nil
+}
+
+// isHTTPVersion reports whether proto has the form HTTP/x.y.
+func isHTTPVersion(proto string) bool {
+	return len(proto) == len("HTTP/1.1") && strings.HasPrefix(proto, "HTTP/") &&
+		isDigit(proto[5]) && proto[6] == '.' && isDigit(proto[7])
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// validHostHeader reports whether host can be written as a Host field value:
+// it must not hold whitespace or control characters such as CR, LF and NUL.
+func validHostHeader(host string) bool {
+	for i := 0; i < len(host); i++ {
+		if c := host[i]; c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// RemoveHopByHop removes the hop-by-hop header fields and the fields named
+// by Connection. Transfer-Encoding is kept, as the body is forwarded as
+// received. Upgrade requests keep Upgrade and a Connection of "Upgrade", so
+// the upgrade still reaches the backend.
+func (h *RequestHead) RemoveHopByHop() {
+	upgrade := h.Header.Get("Upgrade")
+	if !headerHasToken(h.Header, "Connection", "upgrade") {
+		upgrade = ""
+	}
+	for _, value := range h.Header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" && name != "Transfer-Encoding" {
+				h.Header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHop {
+		h.Header.Del(name)
+	}
+	if upgrade != "" {
+		h.Header.Set("Connection", "Upgrade")
+		h.Header.Set("Upgrade", upgrade)
+	}
+}
+
+// headerHasToken reports whether a comma-separated header field contains
+// token, compared case-insensitively.
+func headerHasToken(header http.Header, key, token string) bool {
+	for _, value := range header.Values(key) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AddForwarded records a hop from client in X-Forwarded-For and Forwarded,
+// appending to what earlier proxies recorded, and sets X-Forwarded-Host and
+// X-Forwarded-Proto. proto is the scheme the client used, such as "http";
+// it is omitted when empty.
+func (h *RequestHead) AddForwarded(client net.Addr, proto string) {
+	var ip netip.Addr
+	if ap, ok := addrPort(client); ok {
+		ip = ap.Addr().Unmap()
+	}
+
+	if ip.IsValid() {
+		if prior := strings.Join(h.Header.Values("X-Forwarded-For"), ", "); prior != "" {
+			h.Header.Set("X-Forwarded-For", prior+", "+ip.String())
+		} else {
+			h.Header.Set("X-Forwarded-For", ip.String())
+		}
+	}
+	if h.Host != "" {
+		h.Header.Set("X-Forwarded-Host", h.Host)
+	}
+	if proto != "" {
+		h.Header.Set("X-Forwarded-Proto", proto)
+	}
+
+	var params []string
+	switch {
+	case ip.Is6():
+		params = append(params, `for="[`+ip.String()+`]"`)
+	case ip.IsValid():
+		params = append(params, "for="+ip.String())
+	default:
+		params = append(params, "for=unknown")
+	}
+	if h.Host != "" {
+		params = append(params, "host="+strconv.Quote(h.Host))
+	}
+	if proto != "" {
+		params = append(params, "proto="+proto)
+	}
+	element := strings.Join(params, ";")
+	if prior := strings.Join(h.Header.Values("Forwarded"), ", "); prior != "" {
+		element = prior + ", " + element
+	}
+	h.Header.Set("Forwarded", element)
+}
+
+// RewriteRequestHead reads the first HTTP/1.x request head from r, applies
+// rewrite to it and puts the serialized result back in place of the
+// original head. The body and anything after it are left untouched. If
+// rewrite returns an error, r is left unchanged. A limit of 0 means
+// DefaultMaxHeadBytes.
+func RewriteRequestHead(r PutBacker, limit int, rewrite func(*RequestHead) error) error {
+	h, err := ReadRequestHead(r, limit)
+	if err != nil {
+		return err
+	}
+	if err := rewrite(h); err != nil {
+		return err
+	}
+	b, err := h.AppendBinary(nil)
+	if err != nil {
+		return err
+	}
+	if err := discard(r, len(h.Raw)); err != nil {
+		return err
+	}
+	r.PutBack(b)
+	return nil
+}
+
+// rewriteState is the position of RequestRewriter in the stream.
+type rewriteState int
+
+const (
+	rewriteHead rewriteState = iota
+	rewriteChunkSize
+	rewriteTrailer
+	rewriteRaw
+)
+
+// RequestRewriter reads a stream of HTTP/1.x requests from R and rewrites
+// request heads with Rewrite according to Mode. Bodies are passed through
+// unchanged. Once a request asks for a protocol switch with CONNECT or
+// Upgrade, the rest of the stream is passed through as is, as it is when
+// the stream ends inside a request head. Malformed heads and framing stop
+// the stream with an error rather than guess where requests end.
+type RequestRewriter struct {
+	R       PutBacker
+	Mode    RewriteMode
+	Limit   int // Request head limit; zero means DefaultMaxHeadBytes
+	Rewrite func(*RequestHead) error
+
+	state     rewriteState
+	remaining int64 // bytes to pass through before state applies
+	err       error
+}
+
+// Read reads the rewritten stream.
+func (rw *RequestRewriter) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for rw.err == nil {
+		if rw.remaining > 0 {
+			n, err := rw.R.Read(p[:min(int64(len(p)), rw.remaining)])
+			rw.remaining -= int64(n)
+			if err == io.EOF && rw.remaining > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		switch rw.state {
+		case rewriteRaw:
+			return rw.R.Read(p)
+		case rewriteHead:
+			rw.err = rw.rewriteHead()
+		case rewriteChunkSize:
+			rw.err = rw.chunkSize()
+		case rewriteTrailer:
+			rw.err = rw.trailer()
+		}
+	}
+	return 0, rw.err
+}
+
+// rewriteHead rewrites the request head at the start of R and plans the
+// pass-through of its body.
+func (rw *RequestRewriter) rewriteHead() error {
+	h, err := ReadRequestHead(rw.R, rw.Limit)
+	if errors.Is(err, io.EOF) {
+		rw.state = rewriteRaw
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	bodyLen, chunked, err := requestFraming(h)
+	if err != nil {
+		return err
+	}
+	upgrade := h.Method == http.MethodConnect || h.Header.Get("Upgrade") != ""
+
+	if err := rw.Rewrite(h); err != nil {
+		return err
+	}
+	b, err := h.AppendBinary(nil)
+	if err != nil {
+		return err
+	}
+	if err := discard(rw.R, len(h.Raw)); err != nil {
+		return err
+	}
+	rw.R.PutBack(b)
+
+	rw.remaining = int64(len(b))
+	switch {
+	case rw.Mode == RewriteFirst || upgrade:
+		rw.state = rewriteRaw
+	case chunked:
+		rw.state = rewriteChunkSize
+	default:
+		rw.remaining += bodyLen
+	}
+	return nil
+}
+
+// requestFraming returns how the body of a request is delimited: by
+// chunked transfer coding or by a length, zero for requests without either.
+func requestFraming(h *RequestHead) (length int64, chunked bool, err error) {
+	if te := h.Header.Values("Transfer-Encoding"); len(te) > 0 {
+		codings := strings.Split(strings.Join(te, ","), ",")
+		if !strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") ||
+			len(h.Header.Values("Content-Length")) > 0 {
+			// Rejected by RFC 9112 as the length cannot be determined or
+			// the request may be smuggled.
+			return 0, false, ErrMalformedRequestHead
+		}
+		return 0, true, nil
+	}
+	cl := h.Header.Values("Content-Length")
+	if len(cl) == 0 {
+		return 0, false, nil
+	}
+	for _, v := range cl[1:] {
+		if v != cl[0] {
+			return 0, false, ErrMalformedRequestHead
+		}
+	}
+	length, err = strconv.ParseInt(cl[0], 10, 64)
+	if err != nil || length < 0 || cl[0][0] == '+' {
+		return 0, false, ErrMalformedRequestHead
+	}
+	return length, false, nil
+}
+
+// peekLine peeks the next line of R, including its line ending.
+func (rw *RequestRewriter) peekLine() ([]byte, error) {
+	peeked, err := PeekUntil(rw.R, maxChunkLine, func(p []byte) bool {
+		return bytes.IndexByte(p, '\n') >= 0
+	})
+	if errors.Is(err, ErrPeekLimit) {
+		return nil, ErrMalformedRequestHead
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return peeked[:bytes.IndexByte(peeked, '\n')+1], nil
+}
+
+// chunkSize plans the pass-through of the next chunk of a chunked body.
+func (rw *RequestRewriter) chunkSize() error {
+	line, err := rw.peekLine()
+	if err != nil {
+		return err
+	}
+	size, _, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), ";")
+	n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+	if err != nil || n < 0 {
+		return ErrMalformedRequestHead
+	}
+	rw.remaining = int64(len(line))
+	if n == 0 {
+		rw.state = rewriteTrailer
+		return nil
+	}
+	// chunk data and its CRLF
+	rw.remaining += n + 2
+	return nil
+}
+
+// trailer plans the pass-through of the next trailer line of a chunked
+// body; the empty line ends the request.
+func (rw *RequestRewriter) trailer() error {
+	line, err := rw.peekLine()
+	if err != nil {
+		return err
+	}
+	rw.remaining = int64(len(line))
+	if len(bytes.TrimRight(line, "\r\n")) == 0 {
+		rw.state = rewriteHead
+	}
+	return nil
+}
+
+// rewriteConn is a net.Conn reading through a RequestRewriter. Conn is a
+// PutBackConn or PutBackTCPConn.
+type rewriteConn struct {
+	net.Conn
+	rw *RequestRewriter
+}
+
+func (c *rewriteConn) Read(p []byte) (int, error) {
+	return c.rw.Read(p)
+}
+
+// Metadata returns the Metadata of the wrapped connection.
+func (c *rewriteConn) Metadata() *Metadata {
+	return c.Conn.(WithMetadata).Metadata()
+}
+
+// rewriteTCPConn is a rewriteConn over a TCP connection, which keeps its
+// half-close methods.
+type rewriteTCPConn struct {
+	rewriteConn
+	tcp TCPConn
+}
+
+// CloseRead half-closes the read side of the wrapped connection.
+func (c *rewriteTCPConn) CloseRead() error {
+	return c.tcp.CloseRead()
+}
+
+// CloseWrite half-closes the write side of the wrapped connection.
+func (c *rewriteTCPConn) CloseWrite() error {
+	return c.tcp.CloseWrite()
+}
+
+// RewriteRequests returns a connection whose reads yield the requests sent
+// on conn with their heads rewritten by rewrite, as described for
+// RequestRewriter. Connections that are not PutBackConn or PutBackTCPConn
+// yet are wrapped with WrapConn first; writes, deadlines and Close go to
+// that connection. The returned connection carries its Metadata and, for
+// TCP connections, has CloseRead and CloseWrite.
+func RewriteRequests(
+	conn net.Conn,
+	mode RewriteMode,
+	limit int,
+	rewrite func(*RequestHead) error,
+	pool BufferPool,
+) net.Conn {
+	conn = withPutBack(conn, pool)
+	c := rewriteConn{
+		Conn: conn,
+		rw: &RequestRewriter{
+			R:       conn.(PutBacker),
+			Mode:    mode,
+			Limit:   limit,
+			Rewrite: rewrite,
+		},
+	}
+	if tcp, ok := conn.(TCPConn); ok {
+		return &rewriteTCPConn{rewriteConn: c, tcp: tcp}
+	}
+	return &c
+}
@@ -0,0 +1,224 @@
+package putback_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/asciimoth/putback"
+)
+
+func setHost(h *putback.RequestHead) error {
+	h.Host = "backend.internal"
+	h.Header.Set("X-Rewritten", "1")
+	return nil
+}
+
+func TestRewriteRequestHead(t *testing.T) {
+	const body = "hello"
+	r := &putback.PutBackReader{Reader: strings.NewReader(
+		"POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\n" + body,
+	)}
+	if err := putback.RewriteRequestHead(r, 0, setHost); err != nil {
+		t.Fatalf("RewriteRequestHead: %v", err)
+	}
+	req, err := http.ReadRequest(bufio.NewReader(r))
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	if req.Host != "backend.internal" || req.Header.Get("X-Rewritten") != "1" {
+		t.Fatalf("request = %+v", req)
+	}
+	if got, _ := io.ReadAll(req.Body); string(got) != body {
+		t.Fatalf("body = %q", got)
+	}
+}
+
+func TestRequestRewriter_Modes(t *testing.T) {
+	const stream = "POST /a HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\n\r\nbody" +
+		"POST /b HTTP/1.1\r\nHost: b\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"3;ext=1\r\nabc\r\n0\r\nX-Trailer: t\r\n\r\n" +
+		"GET /c HTTP/1.1\r\nHost: c\r\n\r\n"
+	for _, tc := range []struct {
+		mode     putback.RewriteMode
+		expected []bool
+	}{
+		{putback.RewriteFirst, []bool{true, false, false}},
+		{putback.RewriteEach, []bool{true, true, true}},
+	} {
+		rw := &putback.RequestRewriter{
+			R:       &putback.PutBackReader{Reader: iotest.HalfReader(strings.NewReader(stream))},
+			Mode:    tc.mode,
+			Rewrite: setHost,
+		}
+		br := bufio.NewReader(rw)
+		for i, rewritten := range tc.expected {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				t.Fatalf("mode %d, request %d: %v", tc.mode, i, err)
+			}
+			if got := req.Host == "backend.internal"; got != rewritten {
+				t.Errorf("mode %d, request %d: Host = %q", tc.mode, i, req.Host)
+			}
+			if _, err := io.ReadAll(req.Body); err != nil {
+				t.Fatalf("mode %d, request %d: body: %v", tc.mode, i, err)
+			}
+		}
+		if _, err := br.ReadByte(); err != io.EOF {
+			t.Errorf("mode %d: trailing read: %v", tc.mode, err)
+		}
+	}
+}
+
+func TestRequestRewriter_Upgrade(t *testing.T) {
+	const frames = "GET /not-a-request HTTP/1.1\r\n\r\n"
+	rw := &putback.RequestRewriter{
+		R: &putback.PutBackReader{Reader: strings.NewReader(
+			"GET /ws HTTP/1.1\r\nHost: a\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n" + frames,
+		)},
+		Mode:    putback.RewriteEach,
+		Rewrite: setHost,
+	}
+	br := bufio.NewReader(rw)
+	if _, err := http.ReadRequest(br); err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	if rest, _ := io.ReadAll(br); string(rest) != frames {
+		t.Fatalf("after upgrade = %q", rest)
+	}
+}
+
+func TestRequestRewriter_Smuggling(t *testing.T) {
+	rw := &putback.RequestRewriter{
+		R: &putback.PutBackReader{Reader: strings.NewReader(
+			"POST / HTTP/1.1\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		)},
+		Mode:    putback.RewriteEach,
+		Rewrite: setHost,
+	}
+	if _, err := io.ReadAll(rw); !errors.Is(err, putback.ErrMalformedRequestHead) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestRequestHead_RemoveHopByHop(t *testing.T) {
+	h, err := putback.ParseRequestHead([]byte("GET / HTTP/1.1\r\n" +
+		"Host: a\r\nConnection: keep-alive, X-Private, Upgrade\r\nX-Private: 1\r\n" +
+		"Keep-Alive: timeout=5\r\nUpgrade: websocket\r\nTransfer-Encoding: chunked\r\nAccept: */*\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("ParseRequestHead: %v", err)
+	}
+	h.RemoveHopByHop()
+	for _, name := range []string{"X-Private", "Keep-Alive"} {
+		if h.Header.Get(name) != "" {
+			t.Errorf("%s kept", name)
+		}
+	}
+	for name, want := range map[string]string{
+		"Connection":        "Upgrade",
+		"Upgrade":           "websocket",
+		"Transfer-Encoding": "chunked",
+		"Accept":            "*/*",
+	} {
+		if got := h.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestRequestHead_AddForwarded(t *testing.T) {
+	h, err := putback.ParseRequestHead([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n" +
+		"X-Forwarded-For: 192.0.2.1\r\nForwarded: for=192.0.2.1\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("ParseRequestHead: %v", err)
+	}
+	h.AddForwarded(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, "https")
+	for name, want := range map[string]string{
+		"X-Forwarded-For":   "192.0.2.1, 2001:db8::1",
+		"X-Forwarded-Host":  "example.com",
+		"X-Forwarded-Proto": "https",
+		"Forwarded":         `for=192.0.2.1, for="[2001:db8::1]";host="example.com";proto=https`,
+	} {
+		if got := h.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestRewriteRequests_Conn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		_, _ = client.Write([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\nGET / HTTP/1.1\r\nHost: b\r\n\r\n"))
+	}()
+	conn := putback.RewriteRequests(server, putback.RewriteEach, 0, setHost, nil)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for i := range 2 {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if req.Host != "backend.internal" {
+			t.Errorf("request %d: Host = %q", i, req.Host)
+		}
+	}
+}
+
+func TestRequestHead_AppendBinaryInjection(t *testing.T) {
+	for name, rewrite := range map[string]func(*putback.RequestHead){
+		"host crlf":  func(h *putback.RequestHead) { h.Host = "a\r\nX-Injected: 1" },
+		"host nul":   func(h *putback.RequestHead) { h.Host = "a\x00" },
+		"proto crlf": func(h *putback.RequestHead) { h.Proto = "HTTP/1.1\r\nX-Injected: 1" },
+		"proto":      func(h *putback.RequestHead) { h.Proto = "HTTP/11" },
+	} {
+		h, err := putback.ParseRequestHead([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rewrite(h)
+		if _, err := h.AppendBinary(nil); !errors.Is(err, putback.ErrMalformedRequestHead) {
+			t.Errorf("%s: err = %v, want ErrMalformedRequestHead", name, err)
+		}
+	}
+}
+
+func TestRewriteRequests_TCPConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb := putback.WrapConn(server, nil, nil)
+	pb.(putback.WithMetadata).Metadata().ClientHello = &putback.ClientHello{ServerName: "a"}
+	conn := putback.RewriteRequests(pb, putback.RewriteFirst, 0, setHost, nil)
+	defer conn.Close()
+
+	if m, ok := conn.(putback.WithMetadata); !ok || m.Metadata().ClientHello.ServerName != "a" {
+		t.Fatalf("Metadata not carried over by %T", conn)
+	}
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatalf("%T lacks CloseWrite", conn)
+	}
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	if n, err := client.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("client read after CloseWrite = %d, %v", n, err)
+	}
+}
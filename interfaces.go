@@ -55,3 +55,10 @@ type UDPConn interface {
 	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
 	WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error)
 }
+
+// PutBacker is implemented by readers that accept bytes put back in front of
+// the stream, such as the stream wrappers of this package.
+type PutBacker interface {
+	io.Reader
+	PutBack(bytes []byte)
+}
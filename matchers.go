@@ -0,0 +1,346 @@
+package putback
+
+import (
+	"bytes"
+	"regexp"
+	"regexp/syntax"
+)
+
+// MinLener is implemented by matchers that cannot answer Match before a
+// number of bytes has been peeked.
+type MinLener interface {
+	MinLen() int
+}
+
+// MinPeek returns the number of bytes worth peeking before consulting
+// matchers: the smallest MinLen among them. Matchers that do not implement
+// MinLener count as 1. A Mux does not consult its routes before MinPeek
+// bytes of a connection have been peeked, unless the connection ends or
+// its SniffTimeout expires first.
+func MinPeek(matchers ...Matcher) int {
+	n := 0
+	for i, m := range matchers {
+		l := minLen(m)
+		if i == 0 || l < n {
+			n = l
+		}
+	}
+	return n
+}
+
+func minLen(m Matcher) int {
+	if ml, ok := m.(MinLener); ok {
+		return ml.MinLen()
+	}
+	return 1
+}
+
+// ConnMatcher is implemented by matchers that keep state between the Match
+// calls for one connection, such as how far the peeked bytes were parsed. A
+// Mux calls ForConn for every connection it sniffs and uses the returned
+// Matcher for that connection only. The matcher itself stays usable, without
+// such state, on any stream.
+type ConnMatcher interface {
+	Matcher
+	ForConn() Matcher
+}
+
+// forConn returns the Matcher to use for a single connection.
+func forConn(m Matcher) Matcher {
+	if cm, ok := m.(ConnMatcher); ok {
+		return cm.ForConn()
+	}
+	return m
+}
+
+// forConnAll applies forConn to every matcher.
+func forConnAll(matchers []Matcher) []Matcher {
+	c := make([]Matcher, len(matchers))
+	for i, m := range matchers {
+		c[i] = forConn(m)
+	}
+	return c
+}
+
+// prefixMatcher matches streams starting with any of its prefixes.
+type prefixMatcher struct {
+	prefixes [][]byte
+}
+
+// Prefix returns a Matcher for streams that start with prefix.
+func Prefix(prefix string) Matcher {
+	return AnyPrefix(prefix)
+}
+
+// AnyPrefix returns a Matcher for streams that start with any of prefixes.
+func AnyPrefix(prefixes ...string) Matcher {
+	m := &prefixMatcher{}
+	for _, p := range prefixes {
+		m.prefixes = append(m.prefixes, []byte(p))
+	}
+	return m
+}
+
+func (m *prefixMatcher) Match(peeked []byte) MatchResult {
+	res := NoMatch
+	for _, p := range m.prefixes {
+		if len(peeked) >= len(p) {
+			if bytes.HasPrefix(peeked, p) {
+				return Match
+			}
+		} else if bytes.HasPrefix(p, peeked) {
+			res = NeedMore
+		}
+	}
+	return res
+}
+
+func (m *prefixMatcher) MinLen() int {
+	n := 0
+	for i, p := range m.prefixes {
+		if i == 0 || len(p) < n {
+			n = len(p)
+		}
+	}
+	return n
+}
+
+// regexMatcher matches streams whose first bytes match a regular expression.
+type regexMatcher struct {
+	re     *regexp.Regexp
+	prefix string // literal prefix every match starts the stream with
+	limit  int
+}
+
+// Regex returns a Matcher that runs re against at most limit peeked bytes.
+// Anchor re with \A to match at the start of the stream only. Regex answers
+// NeedMore until re matches or limit bytes are peeked, holding back the
+// routes of a Mux registered after it, unless re starts with \A followed by
+// a literal: then it answers NoMatch as soon as the peeked bytes leave that
+// literal. Keep limit small, or register Regex routes last.
+func Regex(re *regexp.Regexp, limit int) Matcher {
+	return &regexMatcher{re: re, prefix: anchoredPrefix(re), limit: limit}
+}
+
+// anchoredPrefix returns the literal every match of re starts the input
+// with, or "" if re does not start with \A. A ^ is not taken as an anchor,
+// since its meaning depends on the flags re was compiled with.
+func anchoredPrefix(re *regexp.Regexp) string {
+	tree, err := syntax.Parse(re.String(), syntax.Perl&^syntax.OneLine)
+	if err != nil {
+		return ""
+	}
+	tree = tree.Simplify()
+	if tree.Op != syntax.OpConcat || tree.Sub[0].Op != syntax.OpBeginText {
+		return ""
+	}
+	var prefix []rune
+	for _, sub := range tree.Sub[1:] {
+		if sub.Op != syntax.OpLiteral || sub.Flags&syntax.FoldCase != 0 {
+			break
+		}
+		prefix = append(prefix, sub.Rune...)
+	}
+	return string(prefix)
+}
+
+func (m *regexMatcher) Match(peeked []byte) MatchResult {
+	if len(peeked) > m.limit {
+		peeked = peeked[:m.limit]
+	}
+	if n := min(len(peeked), len(m.prefix)); string(peeked[:n]) != m.prefix[:n] {
+		return NoMatch
+	}
+	if m.re.Match(peeked) {
+		return Match
+	}
+	if len(peeked) < m.limit {
+		return NeedMore
+	}
+	return NoMatch
+}
+
+func (m *regexMatcher) MinLen() int {
+	return 1
+}
+
+// lengthMatcher matches streams of at least n bytes.
+type lengthMatcher int
+
+// LengthAtLeast returns a Matcher for streams of at least n bytes. Combined
+// with And it makes another matcher wait for enough data.
+func LengthAtLeast(n int) Matcher {
+	return lengthMatcher(n)
+}
+
+func (m lengthMatcher) Match(peeked []byte) MatchResult {
+	if len(peeked) >= int(m) {
+		return Match
+	}
+	return NeedMore
+}
+
+func (m lengthMatcher) MinLen() int {
+	return int(m)
+}
+
+// andMatcher matches when all of its matchers match.
+type andMatcher []Matcher
+
+// And returns a Matcher that matches when all of matchers match and rejects
+// as soon as one of them rejects.
+func And(matchers ...Matcher) Matcher {
+	return andMatcher(matchers)
+}
+
+func (m andMatcher) Match(peeked []byte) MatchResult {
+	res := Match
+	for _, mm := range m {
+		switch mm.Match(peeked) {
+		case NoMatch:
+			return NoMatch
+		case NeedMore:
+			res = NeedMore
+		}
+	}
+	return res
+}
+
+func (m andMatcher) MinLen() int {
+	n := 0
+	for _, mm := range m {
+		n = max(n, minLen(mm))
+	}
+	return n
+}
+
+func (m andMatcher) ForConn() Matcher {
+	return andMatcher(forConnAll(m))
+}
+
+// orMatcher matches when any of its matchers matches.
+type orMatcher []Matcher
+
+// Or returns a Matcher that matches as soon as one of matchers matches and
+// rejects when all of them reject.
+func Or(matchers ...Matcher) Matcher {
+	return orMatcher(matchers)
+}
+
+func (m orMatcher) Match(peeked []byte) MatchResult {
+	res := NoMatch
+	for _, mm := range m {
+		switch mm.Match(peeked) {
+		case Match:
+			return Match
+		case NeedMore:
+			res = NeedMore
+		}
+	}
+	return res
+}
+
+func (m orMatcher) MinLen() int {
+	return MinPeek(m...)
+}
+
+func (m orMatcher) ForConn() Matcher {
+	return orMatcher(forConnAll(m))
+}
+
+// notMatcher inverts the verdict of a matcher.
+type notMatcher struct {
+	m Matcher
+}
+
+// Not returns a Matcher that matches when m rejects and rejects when m
+// matches. NeedMore is passed through.
+func Not(m Matcher) Matcher {
+	return notMatcher{m: m}
+}
+
+func (m notMatcher) Match(peeked []byte) MatchResult {
+	switch m.m.Match(peeked) {
+	case Match:
+		return NoMatch
+	case NoMatch:
+		return Match
+	}
+	return NeedMore
+}
+
+func (m notMatcher) MinLen() int {
+	return minLen(m.m)
+}
+
+func (m notMatcher) ForConn() Matcher {
+	return notMatcher{m: forConn(m.m)}
+}
+
+// HTTP1 returns a Matcher for HTTP/1.x requests, recognized by their method.
+func HTTP1() Matcher {
+	return AnyPrefix(
+		"GET ", "HEAD ", "POST ", "PUT ", "DELETE ",
+		"CONNECT ", "OPTIONS ", "TRACE ", "PATCH ",
+	)
+}
+
+// SSH returns a Matcher for SSH clients, recognized by their version banner.
+func SSH() Matcher {
+	return Prefix("SSH-")
+}
+
+// SOCKS4 returns a Matcher for SOCKS4 and SOCKS4a requests.
+func SOCKS4() Matcher {
+	return And(LengthAtLeast(2), MatcherFunc(matchSOCKS4))
+}
+
+func matchSOCKS4(peeked []byte) MatchResult {
+	// version 4, command CONNECT or BIND
+	if len(peeked) > 0 && peeked[0] != 4 {
+		return NoMatch
+	}
+	if len(peeked) > 1 && peeked[1] != 1 && peeked[1] != 2 {
+		return NoMatch
+	}
+	return Match
+}
+
+// SOCKS5 returns a Matcher for SOCKS5 greetings.
+func SOCKS5() Matcher {
+	return And(LengthAtLeast(2), MatcherFunc(matchSOCKS5))
+}
+
+func matchSOCKS5(peeked []byte) MatchResult {
+	// version 5 with at least one authentication method
+	if len(peeked) > 0 && peeked[0] != 5 {
+		return NoMatch
+	}
+	if len(peeked) > 1 && peeked[1] == 0 {
+		return NoMatch
+	}
+	return Match
+}
+
+// SOCKS returns a Matcher for SOCKS4, SOCKS4a and SOCKS5 clients.
+func SOCKS() Matcher {
+	return Or(SOCKS4(), SOCKS5())
+}
+
+// TLS returns a Matcher for TLS clients, recognized by a handshake record
+// that starts with a ClientHello.
+func TLS() Matcher {
+	return And(LengthAtLeast(6), MatcherFunc(matchTLS))
+}
+
+func matchTLS(peeked []byte) MatchResult {
+	// record type handshake, legacy version 3.x, handshake type ClientHello
+	switch {
+	case len(peeked) > 0 && peeked[0] != 0x16,
+		len(peeked) > 1 && peeked[1] != 3,
+		len(peeked) > 2 && peeked[2] > 4,
+		len(peeked) > 5 && peeked[5] != 1:
+		return NoMatch
+	}
+	return Match
+}
@@ -0,0 +1,63 @@
+package putback_test
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/asciimoth/putback"
+)
+
+func TestMatchers(t *testing.T) {
+	const (
+		more = putback.NeedMore
+		yes  = putback.Match
+		no   = putback.NoMatch
+	)
+	clientHello := "\x16\x03\x01\x02\x00\x01"
+	tests := []struct {
+		name    string
+		matcher putback.Matcher
+		peeked  string
+		want    putback.MatchResult
+	}{
+		{"prefix partial", putback.Prefix("SSH-"), "SS", more},
+		{"prefix full", putback.Prefix("SSH-"), "SSH-2.0", yes},
+		{"prefix mismatch", putback.Prefix("SSH-"), "SX", no},
+		{"any prefix", putback.AnyPrefix("ab", "abcd"), "abc", yes},
+		{"regex wait", putback.Regex(regexp.MustCompile(`\A\w+ /\S* HTTP/1\.[01]\r\n`), 64), "GET / HT", more},
+		{"regex match", putback.Regex(regexp.MustCompile(`\A\w+ /\S* HTTP/1\.[01]\r\n`), 64), "GET / HTTP/1.1\r\n", yes},
+		{"regex limit", putback.Regex(regexp.MustCompile(`\Aa+b`), 4), "aaaaa", no},
+		{"regex prefix mismatch", putback.Regex(regexp.MustCompile(`\ASSH-2\.0-\S+`), 64), "SX", no},
+		{"regex prefix wait", putback.Regex(regexp.MustCompile(`\ASSH-2\.0-\S+`), 64), "SSH", more},
+		{"regex unanchored", putback.Regex(regexp.MustCompile(`SSH-`), 64), "xSS", more},
+		{"and", putback.And(putback.Prefix("a"), putback.LengthAtLeast(3)), "ab", more},
+		{"and reject", putback.And(putback.Prefix("a"), putback.LengthAtLeast(3)), "b", no},
+		{"or", putback.Or(putback.Prefix("x"), putback.Prefix("ab")), "a", more},
+		{"not", putback.Not(putback.Prefix("GET")), "POST", yes},
+		{"http1", putback.HTTP1(), "OPTIONS * HTTP/1.1", yes},
+		{"http1 h2 preface", putback.HTTP1(), "PRI * HTTP/2.0", no},
+		{"ssh", putback.SSH(), "SSH-2.0-OpenSSH_9.6", yes},
+		{"socks4", putback.SOCKS(), "\x04\x01\x00\x50", yes},
+		{"socks5", putback.SOCKS(), "\x05\x02\x00\x02", yes},
+		{"socks wait", putback.SOCKS(), "\x05", more},
+		{"socks5 no methods", putback.SOCKS5(), "\x05\x00", no},
+		{"tls", putback.TLS(), clientHello, yes},
+		{"tls wait", putback.TLS(), clientHello[:3], more},
+		{"tls alert", putback.TLS(), "\x15\x03\x03", no},
+	}
+	for _, tt := range tests {
+		if got := tt.matcher.Match([]byte(tt.peeked)); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMinPeek(t *testing.T) {
+	got := putback.MinPeek(putback.TLS(), putback.SSH(), putback.SOCKS())
+	if got != 2 {
+		t.Fatalf("unexpected MinPeek %d", got)
+	}
+	if got := putback.MinPeek(putback.And(putback.SSH(), putback.LengthAtLeast(8))); got != 8 {
+		t.Fatalf("unexpected MinPeek for And %d", got)
+	}
+}
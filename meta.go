@@ -0,0 +1,70 @@
+package putback
+
+import "net"
+
+// Static type assertion
+var (
+	_ WithMetadata = &PutBackConn{}
+	_ WithMetadata = &PutBackTCPConn{}
+)
+
+// Metadata holds what was learned about a connection while sniffing it.
+type Metadata struct {
+	// ClientHello is the sniffed TLS ClientHello, if any.
+	ClientHello *ClientHello
+	// JA3 and JA4 are the TLS fingerprints of ClientHello, if any.
+	JA3 string
+	JA4 string
+	// Proxy is the PROXY protocol header the connection started with, if
+	// any. When it carries addresses, RemoteAddr and LocalAddr report them.
+	Proxy *ProxyHeader
+}
+
+// remoteAddr returns the proxied source address, or nil.
+func (m *Metadata) remoteAddr() net.Addr {
+	if m.Proxy == nil || m.Proxy.Command != ProxyCmdProxy {
+		return nil
+	}
+	return m.Proxy.Source
+}
+
+// localAddr returns the proxied destination address, or nil.
+func (m *Metadata) localAddr() net.Addr {
+	if m.Proxy == nil || m.Proxy.Command != ProxyCmdProxy {
+		return nil
+	}
+	return m.Proxy.Destination
+}
+
+// WithMetadata is implemented by connections that carry Metadata.
+type WithMetadata interface {
+	Metadata() *Metadata
+}
+
+// SniffTLS peeks the TLS ClientHello of conn and records the ClientHello and
+// its JA3 and JA4 fingerprints in the Metadata of the returned connection.
+// Connections that are not PutBackConn or PutBackTCPConn yet are wrapped with
+// WrapConn first. The returned connection holds every sniffed byte and is
+// returned even if sniffing fails, so it can be handed on or closed.
+func SniffTLS(conn net.Conn, pool BufferPool) (net.Conn, *ClientHello, error) {
+	conn = withPutBack(conn, pool)
+	hello, err := ReadClientHello(conn.(PutBacker))
+	if err != nil {
+		return conn, nil, err
+	}
+	meta := conn.(WithMetadata).Metadata()
+	meta.ClientHello = hello
+	meta.JA3 = hello.JA3()
+	meta.JA4 = hello.JA4()
+	return conn, hello, nil
+}
+
+// withPutBack returns conn if it already is a PutBackConn or PutBackTCPConn
+// and wraps it with WrapConn otherwise.
+func withPutBack(conn net.Conn, pool BufferPool) net.Conn {
+	switch conn.(type) {
+	case *PutBackConn, *PutBackTCPConn:
+		return conn
+	}
+	return WrapConn(conn, nil, pool)
+}
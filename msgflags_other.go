@@ -0,0 +1,11 @@
+//go:build !unix && !windows
+
+package putback
+
+// Message flags reported by ReadMsg style methods when a buffered packet or
+// its out-of-band data did not fit into the provided buffers. The platform
+// does not define them, so the Linux values are used.
+const (
+	MsgTrunc  = 0x20
+	MsgCtrunc = 0x8
+)
@@ -0,0 +1,12 @@
+//go:build unix
+
+package putback
+
+import "syscall"
+
+// Message flags reported by ReadMsg style methods when a buffered packet or
+// its out-of-band data did not fit into the provided buffers.
+const (
+	MsgTrunc  = syscall.MSG_TRUNC
+	MsgCtrunc = syscall.MSG_CTRUNC
+)
@@ -0,0 +1,11 @@
+//go:build windows
+
+package putback
+
+// Message flags reported by ReadMsg style methods when a buffered packet or
+// its out-of-band data did not fit into the provided buffers. Values match
+// the Winsock MSG_TRUNC and MSG_CTRUNC flags.
+const (
+	MsgTrunc  = 0x0100
+	MsgCtrunc = 0x0200
+)
@@ -0,0 +1,396 @@
+package putback
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Static type assertion
+var _ net.Listener = &muxListener{}
+
+// defaultMaxPeek is the number of bytes a Mux peeks at most when MaxPeek is
+// not set.
+const defaultMaxPeek = 4096
+
+// ErrNoMatch is passed to Mux.ErrorHandler for connections that no route
+// matched when there is no fallback route.
+var ErrNoMatch = errors.New("putback: no route matched the connection")
+
+// MatchResult is the verdict of a Matcher on the bytes peeked so far.
+type MatchResult int
+
+const (
+	// NeedMore means the matcher cannot decide until more bytes are peeked.
+	NeedMore MatchResult = iota
+	// Match means the connection belongs to the route of the matcher.
+	Match
+	// NoMatch means the connection does not belong to the route.
+	NoMatch
+)
+
+// Matcher decides whether a connection belongs to a route, given the bytes
+// peeked from the start of the connection so far. Match may be called
+// repeatedly with a growing prefix of the same stream.
+type Matcher interface {
+	Match(peeked []byte) MatchResult
+}
+
+// MatcherFunc adapts an ordinary function to the Matcher interface.
+type MatcherFunc func(peeked []byte) MatchResult
+
+// Match returns f(peeked).
+func (f MatcherFunc) Match(peeked []byte) MatchResult {
+	return f(peeked)
+}
+
+// Mux routes connections accepted from a net.Listener to child listeners by
+// sniffing their first bytes. Every accepted connection is peeked in its own
+// goroutine until the registered matchers decide; the connection is then
+// wrapped with WrapConn, so the sniffed bytes are read again by whoever
+// accepts it from the child listener.
+//
+// Routes are tried in the order they were registered: the first route that
+// matches wins, but only once every route registered before it has answered
+// NoMatch, so a matcher that keeps answering NeedMore, such as Regex, holds
+// back every route registered after it. Matchers are first consulted once
+// MinPeek bytes (the smallest MinLen of the route matchers) have been
+// peeked, or earlier if the connection ends or SniffTimeout expires, and
+// then after every read. Connections no route wants go to the Fallback
+// listener if there is one and to ErrorHandler otherwise.
+type Mux struct {
+	// Pool is passed to WrapConn for routed connections. May be nil.
+	Pool BufferPool
+	// SniffTimeout bounds the time spent peeking a single connection.
+	// Matchers still waiting for bytes when it expires count as NoMatch.
+	// Zero means no limit.
+	SniffTimeout time.Duration
+	// MaxPeek is the maximum number of bytes peeked from a connection.
+	// Matchers still waiting for bytes at this point count as NoMatch.
+	// Zero means 4096.
+	MaxPeek int
+	// ErrorHandler is called with connections that could not be routed,
+	// either because sniffing failed or with ErrNoMatch. The handler owns
+	// the connection, which still holds the sniffed bytes. If nil, such
+	// connections are closed.
+	ErrorHandler func(conn net.Conn, err error)
+
+	l    net.Listener
+	done chan struct{}
+	once sync.Once
+
+	mu       sync.Mutex
+	routes   []*muxListener
+	fallback *muxListener
+	sniffing map[net.Conn]struct{}
+}
+
+// NewMux returns a Mux that routes connections accepted from l. Register the
+// routes, then call Serve.
+func NewMux(l net.Listener) *Mux {
+	return &Mux{
+		l:        l,
+		done:     make(chan struct{}),
+		sniffing: make(map[net.Conn]struct{}),
+	}
+}
+
+// Match registers a route for connections matched by matcher and returns the
+// listener the routed connections are accepted from.
+func (m *Mux) Match(matcher Matcher) net.Listener {
+	ml := m.newListener(matcher)
+	m.mu.Lock()
+	m.routes = append(m.routes, ml)
+	m.mu.Unlock()
+	return ml
+}
+
+// Fallback returns the listener for connections no route matched. Calling
+// Fallback more than once returns the same listener.
+func (m *Mux) Fallback() net.Listener {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fallback == nil {
+		m.fallback = m.newListener(nil)
+	}
+	return m.fallback
+}
+
+func (m *Mux) newListener(matcher Matcher) *muxListener {
+	return &muxListener{
+		mux:     m,
+		matcher: matcher,
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+}
+
+// Serve accepts connections from the wrapped listener and routes them until
+// the listener fails or the Mux is closed. Temporary accept errors, such as
+// running out of file descriptors, are retried with a growing delay of up to
+// one second, like net/http.Server does. Serve returns nil after Close and
+// the accept error otherwise; in both cases every child listener is closed.
+func (m *Mux) Serve() error {
+	var delay time.Duration
+	for {
+		c, err := m.l.Accept()
+		if err != nil {
+			select {
+			case <-m.done:
+				return nil
+			default:
+			}
+			if temporary(err) {
+				delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+				t := time.NewTimer(delay)
+				select {
+				case <-t.C:
+				case <-m.done:
+					t.Stop()
+					return nil
+				}
+				continue
+			}
+			m.closeListeners(err)
+			return err
+		}
+		delay = 0
+		go m.serveConn(c)
+	}
+}
+
+// temporary reports whether an accept error may go away by itself.
+func temporary(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && (ne.Temporary() || ne.Timeout())
+}
+
+// Close closes the wrapped listener, every child listener and every
+// connection that is still being sniffed.
+func (m *Mux) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.done)
+		err = m.l.Close()
+		m.closeListeners(net.ErrClosed)
+		m.mu.Lock()
+		for c := range m.sniffing {
+			_ = c.Close()
+		}
+		m.mu.Unlock()
+	})
+	return err
+}
+
+// Addr returns the address of the wrapped listener.
+func (m *Mux) Addr() net.Addr {
+	return m.l.Addr()
+}
+
+func (m *Mux) closeListeners(err error) {
+	m.mu.Lock()
+	listeners := append([]*muxListener{}, m.routes...)
+	if m.fallback != nil {
+		listeners = append(listeners, m.fallback)
+	}
+	m.mu.Unlock()
+	for _, ml := range listeners {
+		ml.closeWith(err)
+	}
+}
+
+// serveConn sniffs c and hands it to the route it belongs to.
+func (m *Mux) serveConn(c net.Conn) {
+	m.mu.Lock()
+	select {
+	case <-m.done:
+		m.mu.Unlock()
+		_ = c.Close()
+		return
+	default:
+	}
+	m.sniffing[c] = struct{}{}
+	m.mu.Unlock()
+
+	if m.SniffTimeout > 0 {
+		_ = c.SetReadDeadline(time.Now().Add(m.SniffTimeout))
+	}
+	route, peeked, err := m.sniff(c)
+	if m.SniffTimeout > 0 {
+		_ = c.SetReadDeadline(time.Time{})
+	}
+
+	m.mu.Lock()
+	delete(m.sniffing, c)
+	m.mu.Unlock()
+	select {
+	case <-m.done:
+		_ = c.Close()
+		return
+	default:
+	}
+
+	wrapped := WrapConn(c, peeked, m.Pool)
+	switch {
+	case err != nil:
+		m.fail(wrapped, err)
+	case route == nil:
+		m.fail(wrapped, ErrNoMatch)
+	default:
+		route.deliver(wrapped)
+	}
+}
+
+// fail hands a connection that could not be routed to ErrorHandler.
+func (m *Mux) fail(c net.Conn, err error) {
+	if m.ErrorHandler == nil {
+		_ = c.Close()
+		return
+	}
+	m.ErrorHandler(c, err)
+}
+
+// sniff reads from c until the routes decide. It returns the chosen route,
+// which is nil if none matched, and every byte read.
+func (m *Mux) sniff(c net.Conn) (route *muxListener, peeked []byte, err error) {
+	maxPeek := m.MaxPeek
+	if maxPeek <= 0 {
+		maxPeek = defaultMaxPeek
+	}
+	routes := m.connRoutes()
+	minPeek := min(routes.minPeek(), maxPeek)
+	buf := make([]byte, 0, min(max(512, minPeek), maxPeek))
+	for {
+		if len(buf) >= minPeek {
+			if route, ok := m.decide(routes, buf, false); ok {
+				return route, buf, nil
+			}
+		}
+		if len(buf) >= maxPeek {
+			route, _ := m.decide(routes, buf, true)
+			return route, buf, nil
+		}
+		if len(buf) == cap(buf) {
+			buf = slices.Grow(buf, min(cap(buf), maxPeek-len(buf)))
+		}
+		n, rerr := c.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if rerr != nil {
+			if n > 0 && len(buf) >= minPeek {
+				if route, ok := m.decide(routes, buf, false); ok {
+					return route, buf, nil
+				}
+			}
+			if rerr == io.EOF || errors.Is(rerr, os.ErrDeadlineExceeded) {
+				route, _ := m.decide(routes, buf, true)
+				return route, buf, nil
+			}
+			return nil, buf, rerr
+		}
+	}
+}
+
+// connRoute is a route as seen by a single sniffed connection.
+type connRoute struct {
+	l       *muxListener
+	matcher Matcher // from forConn
+}
+
+// connRoutes lists the routes registered so far, with matchers for a single
+// connection.
+type connRoutes []connRoute
+
+// connRoutes returns the current routes with matchers for a new connection.
+func (m *Mux) connRoutes() connRoutes {
+	m.mu.Lock()
+	routes := m.routes
+	m.mu.Unlock()
+	c := make(connRoutes, len(routes))
+	for i, r := range routes {
+		c[i] = connRoute{l: r, matcher: forConn(r.matcher)}
+	}
+	return c
+}
+
+// minPeek returns the number of bytes the routes need at least, which sizes
+// the first read.
+func (routes connRoutes) minPeek() int {
+	matchers := make([]Matcher, len(routes))
+	for i, r := range routes {
+		matchers[i] = r.matcher
+	}
+	return MinPeek(matchers...)
+}
+
+// decide runs the matchers of routes against peeked. ok is false if a
+// matcher that takes precedence still needs more bytes. When final is set
+// NeedMore is treated as NoMatch, so a decision is always made.
+func (m *Mux) decide(routes connRoutes, peeked []byte, final bool) (route *muxListener, ok bool) {
+	m.mu.Lock()
+	fallback := m.fallback
+	m.mu.Unlock()
+	for _, r := range routes {
+		switch r.matcher.Match(peeked) {
+		case Match:
+			return r.l, true
+		case NeedMore:
+			if !final {
+				return nil, false
+			}
+		}
+	}
+	return fallback, true
+}
+
+// muxListener is a route of a Mux.
+type muxListener struct {
+	mux     *Mux
+	matcher Matcher // nil for the fallback route
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+	err     error // returned by Accept once done is closed
+}
+
+// deliver hands c to the next Accept call of the route. If the route is
+// closed before that, c is closed.
+func (ml *muxListener) deliver(c net.Conn) {
+	select {
+	case ml.conns <- c:
+	case <-ml.done:
+		_ = c.Close()
+	}
+}
+
+// Accept waits for and returns the next connection routed to the listener.
+func (ml *muxListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ml.conns:
+		return c, nil
+	case <-ml.done:
+		return nil, ml.err
+	}
+}
+
+// Close closes the route. Connections routed to it afterwards are closed;
+// the Mux and its other routes keep running.
+func (ml *muxListener) Close() error {
+	ml.closeWith(net.ErrClosed)
+	return nil
+}
+
+func (ml *muxListener) closeWith(err error) {
+	ml.once.Do(func() {
+		ml.err = err
+		close(ml.done)
+	})
+}
+
+// Addr returns the address of the listener wrapped by the Mux.
+func (ml *muxListener) Addr() net.Addr {
+	return ml.mux.Addr()
+}
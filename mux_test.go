@@ -0,0 +1,207 @@
+package putback_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asciimoth/putback"
+)
+
+func prefixMatcher(prefix string) putback.Matcher {
+	return putback.MatcherFunc(func(peeked []byte) putback.MatchResult {
+		n := min(len(peeked), len(prefix))
+		if string(peeked[:n]) != prefix[:n] {
+			return putback.NoMatch
+		}
+		if n < len(prefix) {
+			return putback.NeedMore
+		}
+		return putback.Match
+	})
+}
+
+func newMux(t *testing.T) *putback.Mux {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	m := putback.NewMux(l)
+	m.SniffTimeout = 5 * time.Second
+	t.Cleanup(func() { _ = m.Close() })
+	return m
+}
+
+func dialAndWrite(t *testing.T, addr net.Addr, chunks ...string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	go func() {
+		for _, chunk := range chunks {
+			_, _ = c.Write([]byte(chunk))
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	return c
+}
+
+func expectRouted(t *testing.T, l net.Listener, want string) net.Conn {
+	t.Helper()
+	c := acceptSession(t, l)
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(c, got); err != nil || string(got) != want {
+		t.Fatalf("routed conn: %q %v, want %q", got, err, want)
+	}
+	return c
+}
+
+func TestMux_Routes(t *testing.T) {
+	m := newMux(t)
+	httpL := m.Match(prefixMatcher("GET "))
+	sshL := m.Match(prefixMatcher("SSH-"))
+	fallback := m.Fallback()
+	go func() { _ = m.Serve() }()
+
+	// Bytes arrive one at a time, so the mux has to peek incrementally.
+	dialAndWrite(t, m.Addr(), "S", "S", "H", "-2.0-test\r\n")
+	c := expectRouted(t, sshL, "SSH-2.0-test\r\n")
+	if _, ok := c.(*putback.PutBackTCPConn); !ok {
+		t.Fatalf("expected TCP capabilities to be kept, got %T", c)
+	}
+
+	dialAndWrite(t, m.Addr(), "GET / HTTP/1.1\r\n")
+	expectRouted(t, httpL, "GET / HTTP/1.1\r\n")
+
+	dialAndWrite(t, m.Addr(), "GEX")
+	expectRouted(t, fallback, "GEX")
+
+	_ = m.Close()
+	for _, l := range []net.Listener{httpL, sshL, fallback} {
+		if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expected closed child listener, got %v", err)
+		}
+	}
+}
+
+// shortestMatcher records the shortest prefix it was consulted with.
+type shortestMatcher struct {
+	putback.Matcher
+	shortest atomic.Int64
+}
+
+func (m *shortestMatcher) Match(peeked []byte) putback.MatchResult {
+	if n := int64(len(peeked)); m.shortest.Load() == 0 || n < m.shortest.Load() {
+		m.shortest.Store(n)
+	}
+	return m.Matcher.Match(peeked)
+}
+
+func (m *shortestMatcher) MinLen() int {
+	return 4
+}
+
+func TestMux_MinPeek(t *testing.T) {
+	m := newMux(t)
+	ssh := &shortestMatcher{Matcher: prefixMatcher("SSH-")}
+	m.Match(ssh)
+	fallback := m.Fallback()
+	go func() { _ = m.Serve() }()
+
+	// Routes are not consulted before MinPeek bytes arrived.
+	dialAndWrite(t, m.Addr(), "G", "E", "X", "!")
+	expectRouted(t, fallback, "GEX!")
+	if n := ssh.shortest.Load(); n < 4 {
+		t.Fatalf("matcher consulted with %d bytes", n)
+	}
+
+	// A connection that ends earlier is still routed.
+	c := dialAndWrite(t, m.Addr())
+	_, _ = c.Write([]byte("GE"))
+	_ = c.(*net.TCPConn).CloseWrite()
+	expectRouted(t, fallback, "GE")
+}
+
+// temporaryError is an accept error that goes away by itself.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails its first Accept calls with a temporary error.
+type flakyListener struct {
+	net.Listener
+	fails atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.fails.Add(-1) >= 0 {
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestMux_TemporaryAcceptError(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	l := &flakyListener{Listener: inner}
+	l.fails.Store(3)
+	m := putback.NewMux(l)
+	defer m.Close()
+	httpL := m.Match(prefixMatcher("GET "))
+	served := make(chan error, 1)
+	go func() { served <- m.Serve() }()
+
+	dialAndWrite(t, m.Addr(), "GET / HTTP/1.1\r\n")
+	expectRouted(t, httpL, "GET / HTTP/1.1\r\n")
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned %v on a temporary error", err)
+	default:
+	}
+
+	_ = m.Close()
+	if err := <-served; err != nil {
+		t.Fatalf("Serve after Close: %v", err)
+	}
+}
+
+func TestMux_Unmatched(t *testing.T) {
+	m := newMux(t)
+	m.Match(prefixMatcher("GET "))
+	m.MaxPeek = 2
+	unmatched := make(chan []byte, 1)
+	m.ErrorHandler = func(c net.Conn, err error) {
+		defer c.Close()
+		if !errors.Is(err, putback.ErrNoMatch) {
+			t.Errorf("unexpected error %v", err)
+		}
+		// The sniffed bytes are still there.
+		b := make([]byte, 2)
+		_, _ = io.ReadFull(c, b)
+		unmatched <- b
+	}
+	go func() { _ = m.Serve() }()
+
+	// "GE" never decides, so MaxPeek ends sniffing.
+	dialAndWrite(t, m.Addr(), "GE")
+	select {
+	case b := <-unmatched:
+		if !bytes.Equal(b, []byte("GE")) {
+			t.Fatalf("unexpected bytes %q", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("error handler not called")
+	}
+}
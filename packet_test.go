@@ -0,0 +1,472 @@
+package putback_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/asciimoth/putback"
+)
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func TestPutBackUDPConn_ReadMsgUDP_ReplaysOOB(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 53}
+	pb := &putback.PutBackUDPConn{UDPConn: listenUDP(t)}
+	pb.PutBackMsg([]byte("data"), []byte("ctrl"), 42, addr)
+
+	b := make([]byte, 16)
+	oob := make([]byte, 16)
+	n, oobn, flags, from, err := pb.ReadMsgUDP(b, oob)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(b[:n], []byte("data")) || !bytes.Equal(oob[:oobn], []byte("ctrl")) {
+		t.Fatalf("unexpected packet: %q oob %q", b[:n], oob[:oobn])
+	}
+	if flags != 42 || from != addr {
+		t.Fatalf("unexpected flags %d or addr %v", flags, from)
+	}
+}
+
+func TestPutBackUDPConn_ReadMsgUDP_FallsBackToConn(t *testing.T) {
+	server := listenUDP(t)
+	client := listenUDP(t)
+	pb := &putback.PutBackUDPConn{UDPConn: server}
+
+	if _, err := client.WriteToUDP([]byte("live"), server.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	b := make([]byte, 16)
+	n, _, _, from, err := pb.ReadMsgUDPAddrPort(b, make([]byte, 64))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(b[:n], []byte("live")) {
+		t.Fatalf("unexpected data: %q", b[:n])
+	}
+	if from.Port() != uint16(client.LocalAddr().(*net.UDPAddr).Port) {
+		t.Fatalf("unexpected source %v", from)
+	}
+}
+
+func TestBackPacketBuffer_TruncationModes(t *testing.T) {
+	p := make([]byte, 4)
+
+	b := putback.NewBackPacketBuffer[int](nil, nil)
+	b.PutBack([]byte("abcdef"), 1)
+	n, _, flags, _, err := b.ReadMsg(p, nil)
+	if err != nil || n != 4 || flags&putback.MsgTrunc == 0 {
+		t.Fatalf("discard: n=%d flags=%#x err=%v", n, flags, err)
+	}
+	if b.PacketsLeft() != 0 {
+		t.Fatalf("discard: remainder kept")
+	}
+
+	b.Truncate = putback.TruncateKeep
+	b.PutBack([]byte("abcdef"), 2)
+	n, _, flags, _, _ = b.ReadMsg(p, nil)
+	if n != 4 || flags&putback.MsgTrunc == 0 {
+		t.Fatalf("keep: n=%d flags=%#x", n, flags)
+	}
+	n, assoc, _ := b.ReadFrom(p)
+	if !bytes.Equal(p[:n], []byte("ef")) || assoc != 2 {
+		t.Fatalf("keep: unexpected remainder %q (%d)", p[:n], assoc)
+	}
+
+	b.Truncate = putback.TruncateError
+	b.PutBack([]byte("abcdef"), 3)
+	_, _, err = b.ReadFrom(p)
+	var te *putback.PacketTruncatedError
+	if !errors.As(err, &te) || te.Size != 6 || te.BufLen != 4 {
+		t.Fatalf("error: unexpected error %v", err)
+	}
+	big := make([]byte, te.Size)
+	n, _, err = b.ReadFrom(big)
+	if err != nil || !bytes.Equal(big[:n], []byte("abcdef")) {
+		t.Fatalf("error: retry failed: %q %v", big[:n], err)
+	}
+}
+
+func readAll(t *testing.T, b *putback.BackPacketBuffer[int]) []int {
+	t.Helper()
+	var got []int
+	p := make([]byte, 16)
+	for b.PacketsLeft() > 0 {
+		_, assoc, _ := b.ReadFrom(p)
+		got = append(got, assoc)
+	}
+	return got
+}
+
+func TestBackPacketBuffer_Order(t *testing.T) {
+	b := putback.NewBackPacketBuffer[int](nil, nil)
+	b.Append([]byte("a"), 1)
+	b.Append([]byte("b"), 2)
+	b.PutBack([]byte("c"), 0)
+	b.Append([]byte("d"), 3)
+	if got := readAll(t, &b); !slices.Equal(got, []int{0, 1, 2, 3}) {
+		t.Fatalf("unexpected order: %v", got)
+	}
+
+	// Interleaved front and tail operations keep the queue order.
+	var want []int
+	for i := range 100 {
+		if i%3 == 0 {
+			b.PutBack(nil, i)
+			want = slices.Insert(want, 0, i)
+		} else {
+			b.Append(nil, i)
+			want = append(want, i)
+		}
+	}
+	if got := readAll(t, &b); !slices.Equal(got, want) {
+		t.Fatalf("unexpected interleaved order: %v", got)
+	}
+
+	parent := putback.NewBackPacketBuffer[int](nil, nil)
+	parent.Append([]byte("p"), 3)
+	parent.Append([]byte("q"), 4)
+	child := putback.NewBackPacketBuffer(nil, &parent,
+		putback.Packet[int]{Buffer: []byte("x"), Assoc: 1},
+		putback.Packet[int]{Buffer: []byte("y"), Assoc: 2},
+	)
+	if got := readAll(t, &child); !slices.Equal(got, []int{3, 4, 2, 1}) {
+		t.Fatalf("unexpected merge order: %v", got)
+	}
+}
+
+func TestPutBackConns_ZeroLengthPackets(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 53}
+
+	udp := listenUDP(t)
+	// A regression would fall through to the socket, so fail fast instead
+	// of blocking forever.
+	_ = udp.SetReadDeadline(time.Now().Add(time.Second))
+
+	pc := &putback.PutBackPacketConn{PacketConn: udp}
+	pc.PutBack(nil, addr)
+	n, from, err := pc.ReadFrom(make([]byte, 16))
+	if err != nil || n != 0 || from != addr {
+		t.Fatalf("empty datagram: n=%d from=%v err=%v", n, from, err)
+	}
+
+	uc := &putback.PutBackUDPConn{UDPConn: udp}
+	uc.PutBack([]byte("keepalive"), addr)
+	n, ua, err := uc.ReadFromUDP(nil)
+	if err != nil || n != 0 || ua != addr {
+		t.Fatalf("zero-length read: n=%d from=%v err=%v", n, ua, err)
+	}
+	if uc.Buffer.PacketsLeft() != 0 {
+		t.Fatalf("packet not consumed")
+	}
+
+	uc.PutBack([]byte{}, addr)
+	n, ap, err := uc.ReadFromUDPAddrPort(make([]byte, 16))
+	if err != nil || n != 0 || ap.Port() != 53 {
+		t.Fatalf("empty datagram addrport: n=%d from=%v err=%v", n, ap, err)
+	}
+}
+
+type countingPool struct {
+	got, put int
+}
+
+func (c *countingPool) GetBuffer(length int) []byte {
+	c.got++
+	return make([]byte, length)
+}
+
+func (c *countingPool) PutBuffer(buf []byte) { c.put++ }
+
+func TestPutBackUDPConn_PeekFrom(t *testing.T) {
+	server := listenUDP(t)
+	client := listenUDP(t)
+	pool := &countingPool{}
+	pb := &putback.PutBackUDPConn{UDPConn: server}
+	pb.Buffer.Pool = pool
+
+	if _, err := client.WriteToUDP([]byte("handshake"), server.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	head := make([]byte, 4)
+	n, peekAddr, err := pb.PeekFrom(head)
+	if err != nil || !bytes.Equal(head[:n], []byte("hand")) {
+		t.Fatalf("peek: %q %v", head[:n], err)
+	}
+	// Second peek is served from the buffer.
+	n, _, err = pb.PeekFromUDPAddrPort(head)
+	if err != nil || n != 4 || pool.got != 1 {
+		t.Fatalf("second peek: n=%d err=%v gets=%d", n, err, pool.got)
+	}
+
+	b := make([]byte, 16)
+	n, addr, err := pb.ReadFrom(b)
+	if err != nil || !bytes.Equal(b[:n], []byte("handshake")) {
+		t.Fatalf("read: %q %v", b[:n], err)
+	}
+	if addr.String() != peekAddr.String() || addr.String() != client.LocalAddr().String() {
+		t.Fatalf("address mismatch: %v vs %v", addr, peekAddr)
+	}
+	if pool.put != 1 {
+		t.Fatalf("expected buffer to be returned to pool once, got %d", pool.put)
+	}
+}
+
+func TestPutBackPacketConn_PeekFrom(t *testing.T) {
+	server := listenUDP(t)
+	client := listenUDP(t)
+	pool := &countingPool{}
+	pb := &putback.PutBackPacketConn{PacketConn: server}
+	pb.Buffer.Pool = pool
+
+	if _, err := client.WriteTo([]byte("handshake"), server.LocalAddr()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	// A short p gets the head of the packet; the whole packet is kept.
+	head := make([]byte, 4)
+	n, peekAddr, err := pb.PeekFrom(head)
+	if err != nil || !bytes.Equal(head[:n], []byte("hand")) {
+		t.Fatalf("peek: %q %v", head[:n], err)
+	}
+	if pb.Buffer.PacketsLeft() != 1 || pool.got != 1 || pool.put != 0 {
+		t.Fatalf("peek left %d packets, gets=%d puts=%d", pb.Buffer.PacketsLeft(), pool.got, pool.put)
+	}
+
+	b := make([]byte, 16)
+	n, addr, err := pb.ReadFrom(b)
+	if err != nil || !bytes.Equal(b[:n], []byte("handshake")) {
+		t.Fatalf("read: %q %v", b[:n], err)
+	}
+	if addr.String() != peekAddr.String() || addr.String() != client.LocalAddr().String() {
+		t.Fatalf("address mismatch: %v vs %v", addr, peekAddr)
+	}
+	if pb.Buffer.PacketsLeft() != 0 || pool.put != 1 {
+		t.Fatalf("read left %d packets, puts=%d", pb.Buffer.PacketsLeft(), pool.put)
+	}
+
+	// A packet the buffer refuses is still returned, and its buffer goes
+	// back to the pool.
+	pb.Buffer.Limits = putback.PacketLimits{MaxBytes: 4, Policy: putback.DropError}
+	if _, err := client.WriteTo([]byte("refused"), server.LocalAddr()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	n, addr, err = pb.PeekFrom(head)
+	if !errors.Is(err, putback.ErrPacketBufferFull) || !bytes.Equal(head[:n], []byte("refu")) ||
+		addr.String() != client.LocalAddr().String() {
+		t.Fatalf("refused peek: %q %v %v", head[:n], addr, err)
+	}
+	if pb.Buffer.PacketsLeft() != 0 || pool.got != 2 || pool.put != 2 {
+		t.Fatalf("refused peek left %d packets, gets=%d puts=%d", pb.Buffer.PacketsLeft(), pool.got, pool.put)
+	}
+}
+
+func TestBackPacketBuffer_Limits(t *testing.T) {
+	pool := &countingPool{}
+	b := putback.BackPacketBuffer[int]{Pool: pool}
+	b.Limits = putback.PacketLimits{MaxPackets: 2, Policy: putback.DropOldest}
+	for i := range 3 {
+		b.Append([]byte("x"), i)
+	}
+	if got := readAll(t, &b); !slices.Equal(got, []int{1, 2}) {
+		t.Fatalf("drop oldest: %v", got)
+	}
+
+	b.Limits.Policy = putback.DropNewest
+	for i := range 3 {
+		b.Append([]byte("x"), i)
+	}
+	if got := readAll(t, &b); !slices.Equal(got, []int{0, 1}) {
+		t.Fatalf("drop newest: %v", got)
+	}
+
+	b.Limits = putback.PacketLimits{MaxBytes: 4, Policy: putback.DropError}
+	b.PutBack([]byte("abc"), 0)
+	err := b.TryPutBack(putback.Packet[int]{Buffer: []byte("de"), Assoc: 1})
+	if !errors.Is(err, putback.ErrPacketBufferFull) {
+		t.Fatalf("expected full buffer, got %v", err)
+	}
+	// Without an error to return, a refused packet is released.
+	b.Append([]byte("fg"), 2)
+	want := putback.DropStats{Overflow: 2, Rejected: 2, Bytes: 2}
+	if b.Dropped != want {
+		t.Fatalf("unexpected stats %+v", b.Dropped)
+	}
+	// Dropped packets are released, the one refused by TryPutBack stays
+	// with the caller.
+	if pool.put != 7 {
+		t.Fatalf("unexpected releases: %d", pool.put)
+	}
+	if b.PacketsLeft() != 1 || b.BytesLeft() != 3 {
+		t.Fatalf("unexpected contents: %d packets, %d bytes", b.PacketsLeft(), b.BytesLeft())
+	}
+}
+
+func TestBackPacketBuffer_MaxAge(t *testing.T) {
+	b := putback.BackPacketBuffer[int]{}
+	b.Limits.MaxAge = time.Minute
+	b.Append([]byte("stale"), 1)
+	b.Append([]byte("fresh"), 2)
+	b.Packets[1].Time = time.Now().Add(-time.Hour)
+	if b.PacketsLeft() != 2 || b.Dropped.Expired != 0 {
+		t.Fatalf("accessor expired packets")
+	}
+
+	p := make([]byte, 8)
+	n, assoc, ok, _ := b.TryReadFrom(p)
+	if !ok || assoc != 2 || string(p[:n]) != "fresh" {
+		t.Fatalf("unexpected packet %q (%d)", p[:n], assoc)
+	}
+	if b.Dropped.Expired != 1 || b.Dropped.Bytes != 5 || b.PacketsLeft() != 0 {
+		t.Fatalf("unexpected stats %+v", b.Dropped)
+	}
+}
+
+func TestPutBackUDPConn_BufferedReadsDoNotAllocate(t *testing.T) {
+	pb := &putback.PutBackUDPConn{}
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}
+	ap := netip.MustParseAddrPort("10.0.0.2:443")
+	pkt := []byte("datagram")
+	p := make([]byte, 16)
+
+	// Let the packet slice reach its steady capacity.
+	pb.PutBack(pkt, addr)
+	_, _, _ = pb.ReadFromUDP(p)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		pb.PutBack(pkt, addr)
+		if _, from, _ := pb.ReadFromUDP(p); from != addr {
+			t.Fatalf("unexpected addr %v", from)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("ReadFromUDP allocated %v times", allocs)
+	}
+
+	allocs = testing.AllocsPerRun(100, func() {
+		pb.PutBack(pkt, addr)
+		if _, from, _ := pb.ReadFromUDPAddrPort(p); from.Port() != 443 {
+			t.Fatalf("unexpected addr %v", from)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("ReadFromUDPAddrPort allocated %v times", allocs)
+	}
+
+	// AllocsPerRun calls the function once more as a warm-up.
+	pb.PutBackAddrPort(pkt, ap)
+	pb.PutBackAddrPort(pkt, ap)
+	allocs = testing.AllocsPerRun(1, func() {
+		_, from, _ := pb.ReadFromUDP(p)
+		if from.AddrPort() != ap {
+			t.Fatalf("unexpected addr %v", from)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("ReadFromUDP of AddrPort packet allocated %v times", allocs)
+	}
+}
+
+func TestBackPacketBuffer_Ownership(t *testing.T) {
+	pool := &countingPool{}
+	b := putback.BackPacketBuffer[int]{Pool: pool}
+
+	scratch := []byte("first")
+	b.PutBackCopy(scratch, 1)
+	copy(scratch, "XXXXX")
+	if pool.got != 1 {
+		t.Fatalf("expected copy into a pool buffer, got %d gets", pool.got)
+	}
+
+	owned := pool.GetBuffer(6)
+	copy(owned, "second")
+	b.AppendOwned(owned, 2)
+
+	child := putback.NewBackPacketBuffer(nil, &b)
+	if &child.Packets[0].Buffer[0] == &b.Packets[0].Buffer[0] {
+		t.Fatalf("parent packet buffer shared with child")
+	}
+	if pool.got != 4 {
+		t.Fatalf("expected parent packets to be copied from pool, got %d gets", pool.got)
+	}
+
+	p := make([]byte, 8)
+	for _, want := range []string{"first", "second"} {
+		n, _, _ := child.ReadFrom(p)
+		if string(p[:n]) != want {
+			t.Fatalf("child: %q, want %q", p[:n], want)
+		}
+		n, _, _ = b.ReadFrom(p)
+		if string(p[:n]) != want {
+			t.Fatalf("parent: %q, want %q", p[:n], want)
+		}
+	}
+	if pool.put != 4 {
+		t.Fatalf("expected 4 releases, got %d", pool.put)
+	}
+}
+
+func TestBackPacketBuffer_Editing(t *testing.T) {
+	pool := &countingPool{}
+	b := putback.BackPacketBuffer[int]{Pool: pool}
+	for i := range 5 {
+		b.Append([]byte{byte(i)}, i)
+	}
+
+	var seen []int
+	for i, pkt := range b.All() {
+		if int(pkt.Buffer[0]) != i {
+			t.Fatalf("position %d holds packet %d", i, pkt.Assoc)
+		}
+		seen = append(seen, pkt.Assoc)
+	}
+	if !slices.Equal(seen, []int{0, 1, 2, 3, 4}) {
+		t.Fatalf("unexpected iteration order %v", seen)
+	}
+
+	// Drop spoofed datagrams queued during sniffing.
+	b.Filter(func(pkt putback.Packet[int]) bool { return pkt.Assoc%2 == 0 })
+	b.Remove(1)
+	if err := b.Insert(1, putback.Packet[int]{Buffer: []byte{9}, Assoc: 9}); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	_ = b.Insert(b.PacketsLeft(), putback.Packet[int]{Assoc: 7})
+
+	if got := readAll(t, &b); !slices.Equal(got, []int{0, 9, 4, 7}) {
+		t.Fatalf("unexpected order after editing: %v", got)
+	}
+	if pool.put != 7 { // 2 filtered, 1 removed, 4 read
+		t.Fatalf("unexpected releases: %d", pool.put)
+	}
+}
+
+func TestPutBackUDPConn_AddrPortRoundTrip(t *testing.T) {
+	pb := &putback.PutBackUDPConn{}
+	mapped := netip.MustParseAddrPort("[::ffff:192.0.2.1]:53")
+	pb.PutBackAddrPort([]byte("x"), mapped)
+	if _, from, _ := pb.ReadFromUDPAddrPort(make([]byte, 4)); from != mapped {
+		t.Fatalf("address changed to %v", from)
+	}
+
+	// The buffer can seed a plain BackPacketBuffer of *net.UDPAddr.
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 53}
+	pb.PutBack([]byte("y"), addr)
+	child := putback.NewBackPacketBuffer(nil, &pb.Buffer)
+	if _, from, _ := child.ReadFrom(make([]byte, 4)); from != addr {
+		t.Fatalf("unexpected child addr %v", from)
+	}
+}
@@ -0,0 +1,51 @@
+package putback
+
+import (
+	"errors"
+	"io"
+	"slices"
+)
+
+// ErrPeekLimit is returned by PeekUntil when the limit is reached before the
+// peeked bytes are complete.
+var ErrPeekLimit = errors.New("putback: peek limit reached")
+
+// Peek reads up to n bytes from r and puts them back, so they will be read
+// again by the next reads from r. It returns a copy of the bytes it read. If
+// fewer than n bytes could be read, the bytes read so far are still put back
+// and the error from io.ReadFull is returned.
+func Peek(r PutBacker, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	read, err := io.ReadFull(r, buf)
+	buf = buf[:read]
+	r.PutBack(buf)
+	return buf, err
+}
+
+// PeekUntil peeks from r one Read at a time until complete reports that the
+// bytes peeked so far are enough, never asking for more than limit bytes.
+// Unlike Peek it does not wait for more data than the stream has already
+// delivered when complete is satisfied. Every byte read is put back. If limit
+// bytes are peeked without completing, ErrPeekLimit is returned; read errors,
+// including io.EOF, are returned as is.
+func PeekUntil(r PutBacker, limit int, complete func(peeked []byte) bool) ([]byte, error) {
+	buf := make([]byte, 0, min(limit, 512))
+	defer func() { r.PutBack(buf) }()
+	for !complete(buf) {
+		if len(buf) >= limit {
+			return buf, ErrPeekLimit
+		}
+		if len(buf) == cap(buf) {
+			buf = slices.Grow(buf, min(cap(buf), limit-len(buf)))
+		}
+		n, err := r.Read(buf[len(buf):min(cap(buf), limit)])
+		buf = buf[:len(buf)+n]
+		if err != nil {
+			if complete(buf) {
+				return buf, nil
+			}
+			return buf, err
+		}
+	}
+	return buf, nil
+}
@@ -0,0 +1,697 @@
+package putback
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Static type assertion
+var _ net.Listener = &ProxyListener{}
+
+// PROXY protocol signatures and sizes.
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	proxyV1MaxLen    = 107
+	proxyV2HeaderLen = 16
+	proxyV2MaxLen    = proxyV2HeaderLen + 0xffff
+)
+
+// ProxyCommand is the command of a PROXY protocol header.
+type ProxyCommand byte
+
+const (
+	// ProxyCmdLocal marks connections established by the proxy itself,
+	// for example health checks. They carry no client addresses.
+	ProxyCmdLocal ProxyCommand = 0x0
+	// ProxyCmdProxy marks connections relayed on behalf of a client.
+	ProxyCmdProxy ProxyCommand = 0x1
+)
+
+// PROXY protocol v2 TLV types.
+const (
+	ProxyTLVALPN      = 0x01
+	ProxyTLVAuthority = 0x02
+	ProxyTLVCRC32C    = 0x03
+	ProxyTLVNoop      = 0x04
+	ProxyTLVUniqueID  = 0x05
+	ProxyTLVSSL       = 0x20
+	ProxyTLVNetNS     = 0x30
+)
+
+// ProxyPolicy selects how a PROXY protocol header at the start of a
+// connection is treated.
+type ProxyPolicy int
+
+const (
+	// ProxyOptional parses a header if there is one.
+	ProxyOptional ProxyPolicy = iota
+	// ProxyRequired fails connections without a header.
+	ProxyRequired
+	// ProxyRejected fails connections with a header, for listeners that
+	// must not trust one.
+	ProxyRejected
+)
+
+var (
+	// ErrNoProxyHeader is returned for connections without a PROXY
+	// protocol header under ProxyRequired.
+	ErrNoProxyHeader = errors.New("putback: missing PROXY protocol header")
+	// ErrProxyHeaderRejected is returned for connections with a PROXY
+	// protocol header under ProxyRejected.
+	ErrProxyHeaderRejected = errors.New("putback: PROXY protocol header not allowed")
+	// ErrMalformedProxyHeader is returned when a PROXY protocol header
+	// cannot be parsed.
+	ErrMalformedProxyHeader = errors.New("putback: malformed PROXY protocol header")
+	// ErrProxyHeaderTooLarge is returned when a header does not fit into
+	// the 16-bit length field of PROXY protocol v2.
+	ErrProxyHeaderTooLarge = errors.New("putback: PROXY protocol header too large")
+)
+
+// ProxyTLV is a type-length-value field of a PROXY protocol v2 header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader is a parsed PROXY protocol header.
+type ProxyHeader struct {
+	Version int // 1 or 2
+	Command ProxyCommand
+	// Network is the transport of the proxied connection, such as "tcp4",
+	// "tcp6", "udp4", "udp6", "unix" or "unixgram". Empty if unknown.
+	Network string
+	// Source and Destination are the addresses of the proxied connection.
+	// Both are nil for ProxyCmdLocal and unknown networks.
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []ProxyTLV // v2 only
+}
+
+// TLV returns the value of the first TLV of the given type.
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ReadProxyHeader detects a PROXY protocol v1 or v2 header at the start of r.
+// If there is one, it is parsed and consumed from r, leaving the payload that
+// follows it to be read. If there is none, nil is returned with a nil error
+// and r is left intact. Detection reads no more than the stream has already
+// delivered once the first bytes rule a header out, so clients that speak a
+// short greeting and then wait are not blocked.
+func ReadProxyHeader(r PutBacker) (*ProxyHeader, error) {
+	peeked, err := PeekUntil(r, len(proxyV2Sig), func(p []byte) bool {
+		return len(p) >= len(proxyV2Sig) || proxyVersion(p) >= 0
+	})
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	switch proxyVersion(peeked) {
+	case 1:
+		return readProxyV1(r)
+	case 2:
+		return readProxyV2(r)
+	}
+	return nil, nil
+}
+
+// proxyVersion returns the PROXY protocol version p starts with, 0 if p
+// cannot start a header and -1 if p is too short to tell.
+func proxyVersion(p []byte) int {
+	switch {
+	case bytes.HasPrefix(p, proxyV1Prefix):
+		return 1
+	case bytes.HasPrefix(p, proxyV2Sig):
+		return 2
+	case bytes.HasPrefix(proxyV1Prefix, p), bytes.HasPrefix(proxyV2Sig, p):
+		return -1
+	}
+	return 0
+}
+
+// discard consumes n bytes from r.
+func discard(r io.Reader, n int) error {
+	_, err := io.CopyN(io.Discard, r, int64(n))
+	return err
+}
+
+func readProxyV1(r PutBacker) (*ProxyHeader, error) {
+	peeked, err := PeekUntil(r, proxyV1MaxLen, func(p []byte) bool {
+		return bytes.Contains(p, []byte("\r\n"))
+	})
+	if err != nil {
+		if errors.Is(err, ErrPeekLimit) {
+			return nil, ErrMalformedProxyHeader
+		}
+		return nil, err
+	}
+	end := bytes.Index(peeked, []byte("\r\n"))
+	h, ok := parseProxyV1(string(peeked[:end]))
+	if !ok {
+		return nil, ErrMalformedProxyHeader
+	}
+	return h, discard(r, end+2)
+}
+
+func parseProxyV1(line string) (*ProxyHeader, bool) {
+	fields := strings.Split(line, " ")
+	h := &ProxyHeader{Version: 1, Command: ProxyCmdProxy}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, true
+	}
+	if len(fields) != 6 {
+		return nil, false
+	}
+	var want6 bool
+	switch fields[1] {
+	case "TCP4":
+		h.Network = "tcp4"
+	case "TCP6":
+		h.Network = "tcp6"
+		want6 = true
+	default:
+		return nil, false
+	}
+	src, ok1 := parseProxyV1Addr(fields[2], fields[4], want6)
+	dst, ok2 := parseProxyV1Addr(fields[3], fields[5], want6)
+	if !ok1 || !ok2 {
+		return nil, false
+	}
+	h.Source, h.Destination = src, dst
+	return h, true
+}
+
+func parseProxyV1Addr(ip, port string, want6 bool) (*net.TCPAddr, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is6() != want6 || addr.Zone() != "" {
+		return nil, false
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, false
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), true
+}
+
+func readProxyV2(r PutBacker) (*ProxyHeader, error) {
+	peeked, err := Peek(r, proxyV2HeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	total := proxyV2HeaderLen + int(binary.BigEndian.Uint16(peeked[14:]))
+	peeked, err = Peek(r, total)
+	if err != nil {
+		return nil, err
+	}
+	h, ok := parseProxyV2(peeked)
+	if !ok {
+		return nil, ErrMalformedProxyHeader
+	}
+	return h, discard(r, total)
+}
+
+func parseProxyV2(header []byte) (*ProxyHeader, bool) {
+	verCmd, famProto := header[12], header[13]
+	if verCmd>>4 != 2 {
+		return nil, false
+	}
+	h := &ProxyHeader{Version: 2, Command: ProxyCommand(verCmd & 0xf)}
+	if h.Command != ProxyCmdLocal && h.Command != ProxyCmdProxy {
+		return nil, false
+	}
+	body := header[proxyV2HeaderLen:]
+
+	var addrLen int
+	fam, proto := famProto>>4, famProto&0xf
+	switch fam {
+	case 0x1:
+		addrLen = 12
+	case 0x2:
+		addrLen = 36
+	case 0x3:
+		addrLen = 216
+	}
+	if len(body) < addrLen || proto > 2 {
+		return nil, false
+	}
+	if h.Command == ProxyCmdProxy && proto != 0 {
+		h.Network, h.Source, h.Destination = proxyV2Addrs(fam, proto == 2, body[:addrLen])
+	}
+
+	for tlvs := body[addrLen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, false
+		}
+		n := int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+n {
+			return nil, false
+		}
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: tlvs[0], Value: tlvs[3 : 3+n]})
+		if tlvs[0] == ProxyTLVCRC32C && !proxyV2ChecksumOK(header, len(header)-len(tlvs)+3, n) {
+			return nil, false
+		}
+		tlvs = tlvs[3+n:]
+	}
+	return h, true
+}
+
+// proxyV2Addrs decodes the address block of a v2 header.
+func proxyV2Addrs(fam byte, dgram bool, block []byte) (network string, src, dst net.Addr) {
+	ipAddrs := func(ipLen int, network string) (string, net.Addr, net.Addr) {
+		srcIP, _ := netip.AddrFromSlice(block[:ipLen])
+		dstIP, _ := netip.AddrFromSlice(block[ipLen : 2*ipLen])
+		srcAP := netip.AddrPortFrom(srcIP, binary.BigEndian.Uint16(block[2*ipLen:]))
+		dstAP := netip.AddrPortFrom(dstIP, binary.BigEndian.Uint16(block[2*ipLen+2:]))
+		if dgram {
+			return "udp" + network, net.UDPAddrFromAddrPort(srcAP), net.UDPAddrFromAddrPort(dstAP)
+		}
+		return "tcp" + network, net.TCPAddrFromAddrPort(srcAP), net.TCPAddrFromAddrPort(dstAP)
+	}
+	switch fam {
+	case 0x1:
+		return ipAddrs(4, "4")
+	case 0x2:
+		return ipAddrs(16, "6")
+	case 0x3:
+		network = "unix"
+		if dgram {
+			network = "unixgram"
+		}
+		name := func(b []byte) string {
+			if i := bytes.IndexByte(b, 0); i >= 0 {
+				b = b[:i]
+			}
+			return string(b)
+		}
+		return network, &net.UnixAddr{Name: name(block[:108]), Net: network},
+			&net.UnixAddr{Name: name(block[108:216]), Net: network}
+	}
+	return "", nil, nil
+}
+
+// proxyV2ChecksumOK verifies a CRC32C TLV whose value of length n starts at
+// offset at within header.
+func proxyV2ChecksumOK(header []byte, at, n int) bool {
+	if n != 4 {
+		return false
+	}
+	want := binary.BigEndian.Uint32(header[at:])
+	zeroed := bytes.Clone(header)
+	clear(zeroed[at : at+4])
+	return crc32.Checksum(zeroed, castagnoli) == want
+}
+
+// ReadProxyConn reads the PROXY protocol header of conn according to policy
+// and records it in the Metadata of the returned connection, whose
+// RemoteAddr and LocalAddr then report the proxied client and destination.
+// Connections that are not PutBackConn or PutBackTCPConn yet are wrapped
+// with WrapConn first. Payload bytes read past the header stay buffered. The
+// returned connection is non-nil even on error, so it can be closed.
+func ReadProxyConn(conn net.Conn, policy ProxyPolicy, pool BufferPool) (net.Conn, error) {
+	conn = withPutBack(conn, pool)
+	h, err := ReadProxyHeader(conn.(PutBacker))
+	switch {
+	case err != nil:
+		return conn, err
+	case h == nil && policy == ProxyRequired:
+		return conn, ErrNoProxyHeader
+	case h != nil && policy == ProxyRejected:
+		return conn, ErrProxyHeaderRejected
+	}
+	conn.(WithMetadata).Metadata().Proxy = h
+	return conn, nil
+}
+
+// DefaultProxyHeaderTimeout is the time a ProxyListener gives a connection
+// to send its PROXY protocol header when ReadHeaderTimeout is zero.
+const DefaultProxyHeaderTimeout = 10 * time.Second
+
+// ProxyListener wraps a net.Listener and reads the PROXY protocol header of
+// every accepted connection with ReadProxyConn. Headers are read in a
+// goroutine per connection, so a slow client never holds up Accept.
+// Connections failing the Policy, or not sending a complete header within
+// ReadHeaderTimeout, are closed and skipped. With ProxyOptional, a client
+// that sends nothing at all within ReadHeaderTimeout, as those of
+// server-speaks-first protocols do, is accepted without a header once it
+// expires; keep the timeout short for such protocols.
+//
+// Close the ProxyListener rather than the wrapped listener, so connections
+// whose header is still being read are released.
+type ProxyListener struct {
+	net.Listener
+	Policy ProxyPolicy
+	// ReadHeaderTimeout bounds the time a connection may take to send its
+	// header. Zero means DefaultProxyHeaderTimeout, negative no timeout.
+	ReadHeaderTimeout time.Duration
+	Pool              BufferPool // May be nil
+
+	setup   sync.Once
+	results chan proxyAccept
+	done    chan struct{}
+	once    sync.Once
+
+	mu      sync.Mutex
+	reading map[net.Conn]struct{} // connections whose header is being read
+}
+
+// proxyAccept is a connection with a read header, or an accept error.
+type proxyAccept struct {
+	conn net.Conn
+	err  error
+}
+
+// Accept waits for the next connection with a valid header.
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	l.setup.Do(l.init)
+	select {
+	case r := <-l.results:
+		return r.conn, r.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the wrapped listener and every connection whose header is
+// still being read.
+func (l *ProxyListener) Close() error {
+	l.setup.Do(l.init)
+	l.once.Do(func() {
+		close(l.done)
+		l.mu.Lock()
+		for c := range l.reading {
+			_ = c.Close()
+		}
+		l.mu.Unlock()
+	})
+	return l.Listener.Close()
+}
+
+func (l *ProxyListener) init() {
+	l.results = make(chan proxyAccept)
+	l.done = make(chan struct{})
+	l.reading = make(map[net.Conn]struct{})
+	go l.serve()
+}
+
+// serve accepts connections from the wrapped listener and reads their
+// headers concurrently. Accept errors are handed to Accept one at a time, so
+// retrying callers pace the loop.
+func (l *ProxyListener) serve() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.results <- proxyAccept{err: err}:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.readHeader(c)
+	}
+}
+
+// readHeader reads the header of c and hands the connection to Accept.
+func (l *ProxyListener) readHeader(c net.Conn) {
+	l.mu.Lock()
+	select {
+	case <-l.done:
+		l.mu.Unlock()
+		_ = c.Close()
+		return
+	default:
+	}
+	l.reading[c] = struct{}{}
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		delete(l.reading, c)
+		l.mu.Unlock()
+	}()
+
+	timeout := l.ReadHeaderTimeout
+	if timeout == 0 {
+		timeout = DefaultProxyHeaderTimeout
+	}
+	if timeout > 0 {
+		_ = c.SetReadDeadline(time.Now().Add(timeout))
+	}
+	pc, err := ReadProxyConn(c, l.Policy, l.Pool)
+	if err != nil && !(l.Policy == ProxyOptional && silent(pc, err)) {
+		_ = pc.Close()
+		return
+	}
+	if timeout > 0 {
+		_ = c.SetReadDeadline(time.Time{})
+	}
+	select {
+	case l.results <- proxyAccept{conn: pc}:
+	case <-l.done:
+		_ = pc.Close()
+	}
+}
+
+// silent reports whether err is a read deadline that expired before conn
+// sent a single byte.
+func silent(conn net.Conn, err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded) && backBufferOf(conn).BytesLeft() == 0
+}
+
+// NewProxyHeader returns a header of the given version announcing a
+// connection from src to dst. If conn carries Metadata with a sniffed
+// ClientHello, its server name is added as a ProxyTLVAuthority TLV.
+// Other TLVs, such as ProxyTLVALPN, can be appended to the TLVs field.
+// TLVs are only sent by version 2.
+func NewProxyHeader(version int, conn net.Conn) *ProxyHeader {
+	h := &ProxyHeader{
+		Version:     version,
+		Command:     ProxyCmdProxy,
+		Source:      conn.RemoteAddr(),
+		Destination: conn.LocalAddr(),
+	}
+	if m, ok := conn.(WithMetadata); ok {
+		if hello := m.Metadata().ClientHello; hello != nil && hello.ServerName != "" {
+			h.TLVs = append(h.TLVs, ProxyTLV{
+				Type:  ProxyTLVAuthority,
+				Value: []byte(hello.ServerName),
+			})
+		}
+	}
+	return h
+}
+
+// MarshalBinary encodes the header in the wire format of its Version.
+func (h *ProxyHeader) MarshalBinary() ([]byte, error) {
+	return h.AppendBinary(nil)
+}
+
+// AppendBinary appends the header, encoded in the wire format of its
+// Version, to b. Version 1 can only carry TCP addresses, other connections
+// are announced as UNKNOWN. If a ProxyTLVCRC32C TLV is present in a version
+// 2 header, its value is replaced by the checksum of the header.
+func (h *ProxyHeader) AppendBinary(b []byte) ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.appendV1(b), nil
+	case 2:
+		return h.appendV2(b)
+	}
+	return b, fmt.Errorf("putback: unsupported PROXY protocol version %d", h.Version)
+}
+
+// addrPort returns the IP address and port of TCP and UDP addresses.
+func addrPort(addr net.Addr) (netip.AddrPort, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a != nil {
+			return a.AddrPort(), true
+		}
+	case *net.UDPAddr:
+		if a != nil {
+			return a.AddrPort(), true
+		}
+	}
+	return netip.AddrPort{}, false
+}
+
+// proxyAddrPorts returns the source and destination of h in a common family.
+// Mixed families are both mapped to IPv6.
+func (h *ProxyHeader) proxyAddrPorts() (src, dst netip.AddrPort, is4, ok bool) {
+	src, ok1 := addrPort(h.Source)
+	dst, ok2 := addrPort(h.Destination)
+	if h.Command != ProxyCmdProxy || !ok1 || !ok2 || !src.IsValid() || !dst.IsValid() {
+		return src, dst, false, false
+	}
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	if srcIP.Is4() && dstIP.Is4() {
+		return netip.AddrPortFrom(srcIP, src.Port()), netip.AddrPortFrom(dstIP, dst.Port()), true, true
+	}
+	src = netip.AddrPortFrom(netip.AddrFrom16(srcIP.As16()), src.Port())
+	dst = netip.AddrPortFrom(netip.AddrFrom16(dstIP.As16()), dst.Port())
+	return src, dst, false, true
+}
+
+func (h *ProxyHeader) appendV1(b []byte) []byte {
+	_, isTCP := h.Source.(*net.TCPAddr)
+	src, dst, is4, ok := h.proxyAddrPorts()
+	if !ok || !isTCP {
+		return append(b, "PROXY UNKNOWN\r\n"...)
+	}
+	proto := "TCP6"
+	if is4 {
+		proto = "TCP4"
+	}
+	return fmt.Appendf(b, "PROXY %s %s %s %d %d\r\n",
+		proto, src.Addr(), dst.Addr(), src.Port(), dst.Port())
+}
+
+func (h *ProxyHeader) appendV2(b []byte) ([]byte, error) {
+	start := len(b)
+	b = append(b, proxyV2Sig...)
+	b = append(b, 0x20|byte(h.Command&0xf), 0, 0, 0)
+
+	var famProto byte
+	if src, dst, is4, ok := h.proxyAddrPorts(); ok {
+		famProto = 0x21
+		if is4 {
+			famProto = 0x11
+		}
+		b = append(b, src.Addr().AsSlice()...)
+		b = append(b, dst.Addr().AsSlice()...)
+		b = binary.BigEndian.AppendUint16(b, src.Port())
+		b = binary.BigEndian.AppendUint16(b, dst.Port())
+		if _, dgram := h.Source.(*net.UDPAddr); dgram {
+			famProto++
+		}
+	} else if src, ok := h.Source.(*net.UnixAddr); ok && h.Command == ProxyCmdProxy {
+		dst, _ := h.Destination.(*net.UnixAddr)
+		famProto = 0x31
+		if src.Net == "unixgram" {
+			famProto++
+		}
+		for _, a := range []*net.UnixAddr{src, dst} {
+			var name [108]byte
+			if a != nil {
+				copy(name[:], a.Name)
+			}
+			b = append(b, name[:]...)
+		}
+	}
+	b[start+13] = famProto
+
+	crc := -1
+	for _, tlv := range h.TLVs {
+		if len(tlv.Value) > 0xffff {
+			return b[:start], ErrProxyHeaderTooLarge
+		}
+		value := tlv.Value
+		if tlv.Type == ProxyTLVCRC32C && crc < 0 {
+			crc = len(b) + 3
+			value = make([]byte, 4)
+		}
+		b = append(b, tlv.Type)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+		b = append(b, value...)
+	}
+
+	n := len(b) - start - proxyV2HeaderLen
+	if n > 0xffff {
+		return b[:start], ErrProxyHeaderTooLarge
+	}
+	binary.BigEndian.PutUint16(b[start+14:], uint16(n))
+	if crc >= 0 {
+		binary.BigEndian.PutUint32(b[crc:], crc32.Checksum(b[start:], castagnoli))
+	}
+	return b, nil
+}
+
+// WriteProxyHeader writes h to w, followed by the bytes buffered in src if
+// src is a PutBackConn, PutBackTCPConn, PutBackReader or another reader
+// exposing a BackBuffer, in a single Write. The buffered bytes are consumed
+// from src, so copying src to w afterwards continues the stream in order.
+// src may be nil.
+func WriteProxyHeader(w io.Writer, h *ProxyHeader, src io.Reader) error {
+	b, err := h.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if buf := backBufferOf(src); buf != nil {
+		n := len(b)
+		b = slices.Grow(b, buf.BytesLeft())[:n+buf.BytesLeft()]
+		_, _ = buf.Read(b[n:])
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// backBufferOf returns the BackBuffer of the put-back wrappers, or nil.
+func backBufferOf(r io.Reader) *BackBuffer {
+	switch r := r.(type) {
+	case *PutBackConn:
+		return &r.Buffer
+	case *PutBackTCPConn:
+		return &r.Buffer
+	case *PutBackReader:
+		return &r.Buffer
+	case *PutBackReadCloser:
+		return &r.Buffer
+	case *PutBackReadWriter:
+		return &r.Buffer
+	case *PutBackReadWriteCloser:
+		return &r.Buffer
+	case WithBackBuffer:
+		return r.BackBuffer()
+	}
+	return nil
+}
+
+// DialProxy dials address with dial and writes h and the bytes buffered in
+// src as one Write with WriteProxyHeader. Copying src to the returned
+// connection forwards the rest of the stream. If dial is nil, a net.Dialer
+// is used.
+func DialProxy(
+	ctx context.Context,
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+	network, address string,
+	h *ProxyHeader,
+	src io.Reader,
+) (net.Conn, error) {
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	conn, err := dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteProxyHeader(conn, h, src); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
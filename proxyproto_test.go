@@ -0,0 +1,415 @@
+package putback_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/asciimoth/putback"
+)
+
+const proxyV2Sig = "\r\n\r\n\x00\r\nQUIT\n"
+
+// proxyV2 builds a v2 PROXY command header for TCP over IPv4.
+func proxyV2(tlvs []byte, crc bool) []byte {
+	body := []byte{192, 0, 2, 1, 198, 51, 100, 7, 0x30, 0x39, 0x01, 0xbb}
+	body = append(body, tlvs...)
+	if crc {
+		body = append(body, putback.ProxyTLVCRC32C, 0, 4, 0, 0, 0, 0)
+	}
+	h := append([]byte(proxyV2Sig), 0x21, 0x11, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(body)))
+	h = append(h, body...)
+	if crc {
+		sum := crc32.Checksum(h, crc32.MakeTable(crc32.Castagnoli))
+		binary.BigEndian.PutUint32(h[len(h)-4:], sum)
+	}
+	return h
+}
+
+func TestReadProxyHeader_V1(t *testing.T) {
+	r := &putback.PutBackReader{Reader: iotest.OneByteReader(
+		strings.NewReader("PROXY TCP4 192.0.2.1 198.51.100.7 12345 443\r\nGET / HTTP/1.1\r\n"),
+	)}
+	h, err := putback.ReadProxyHeader(r)
+	if err != nil {
+		t.Fatalf("ReadProxyHeader: %v", err)
+	}
+	if h.Version != 1 || h.Network != "tcp4" {
+		t.Fatalf("header = %+v", h)
+	}
+	if got := h.Source.String(); got != "192.0.2.1:12345" {
+		t.Fatalf("source = %s", got)
+	}
+	if got := h.Destination.String(); got != "198.51.100.7:443" {
+		t.Fatalf("destination = %s", got)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "GET / HTTP/1.1\r\n" {
+		t.Fatalf("payload = %q", rest)
+	}
+}
+
+func TestReadProxyHeader_V1Unknown(t *testing.T) {
+	r := &putback.PutBackReader{Reader: strings.NewReader("PROXY UNKNOWN whatever\r\nx")}
+	h, err := putback.ReadProxyHeader(r)
+	if err != nil || h == nil || h.Source != nil {
+		t.Fatalf("ReadProxyHeader = %+v, %v", h, err)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "x" {
+		t.Fatalf("payload = %q", rest)
+	}
+}
+
+func TestReadProxyHeader_V2(t *testing.T) {
+	tlvs := []byte{
+		putback.ProxyTLVAuthority, 0, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm',
+		putback.ProxyTLVALPN, 0, 2, 'h', '2',
+	}
+	data := append(proxyV2(tlvs, true), "payload"...)
+	r := &putback.PutBackReader{Reader: iotest.HalfReader(strings.NewReader(string(data)))}
+	h, err := putback.ReadProxyHeader(r)
+	if err != nil {
+		t.Fatalf("ReadProxyHeader: %v", err)
+	}
+	if h.Version != 2 || h.Command != putback.ProxyCmdProxy || h.Network != "tcp4" {
+		t.Fatalf("header = %+v", h)
+	}
+	if got := h.Source.String(); got != "192.0.2.1:12345" {
+		t.Fatalf("source = %s", got)
+	}
+	if v, ok := h.TLV(putback.ProxyTLVAuthority); !ok || string(v) != "example.com" {
+		t.Fatalf("authority = %q, %v", v, ok)
+	}
+	if v, ok := h.TLV(putback.ProxyTLVALPN); !ok || string(v) != "h2" {
+		t.Fatalf("alpn = %q, %v", v, ok)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "payload" {
+		t.Fatalf("payload = %q", rest)
+	}
+}
+
+func TestReadProxyHeader_Malformed(t *testing.T) {
+	badCRC := proxyV2(nil, true)
+	badCRC[len(badCRC)-1] ^= 0xff
+	for name, data := range map[string]string{
+		"v1 garbage":  "PROXY TCP4 nope\r\n",
+		"v1 no crlf":  "PROXY TCP4 192.0.2.1 198.51.100.7 12345 443 " + string(make([]byte, 128)),
+		"v1 bad port": "PROXY TCP4 192.0.2.1 198.51.100.7 012345 443\r\n",
+		"v2 crc":      string(badCRC),
+	} {
+		r := &putback.PutBackReader{Reader: strings.NewReader(data)}
+		if _, err := putback.ReadProxyHeader(r); !errors.Is(err, putback.ErrMalformedProxyHeader) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+}
+
+func TestReadProxyHeader_None(t *testing.T) {
+	// A short greeting that is not a header must not block waiting for more.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() { _, _ = client.Write([]byte("SSH-")) }()
+	r := &putback.PutBackConn{Conn: server}
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	h, err := putback.ReadProxyHeader(r)
+	if h != nil || err != nil {
+		t.Fatalf("ReadProxyHeader = %+v, %v", h, err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "SSH-" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestReadProxyConn_Policy(t *testing.T) {
+	header := "PROXY TCP4 192.0.2.1 198.51.100.7 12345 443\r\n"
+	cases := []struct {
+		data   string
+		policy putback.ProxyPolicy
+		err    error
+	}{
+		{header + "x", putback.ProxyOptional, nil},
+		{"x", putback.ProxyOptional, nil},
+		{header + "x", putback.ProxyRequired, nil},
+		{"x", putback.ProxyRequired, putback.ErrNoProxyHeader},
+		{header + "x", putback.ProxyRejected, putback.ErrProxyHeaderRejected},
+		{"x", putback.ProxyRejected, nil},
+	}
+	for i, tc := range cases {
+		client, server := net.Pipe()
+		go func() {
+			_, _ = client.Write([]byte(tc.data))
+			_ = client.Close()
+		}()
+		conn, err := putback.ReadProxyConn(server, tc.policy, nil)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("case %d: err = %v, want %v", i, err, tc.err)
+		}
+		if err == nil {
+			rest, _ := io.ReadAll(conn)
+			if string(rest) != "x" {
+				t.Errorf("case %d: payload = %q", i, rest)
+			}
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestProxyListener_RemoteAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	pl := &putback.ProxyListener{
+		Listener:          l,
+		Policy:            putback.ProxyRequired,
+		ReadHeaderTimeout: time.Second,
+	}
+	defer pl.Close()
+
+	// The first connection has no header and must be skipped.
+	dialAndWrite(t, l.Addr(), "hello").Close()
+	c := dialAndWrite(t, l.Addr(), string(proxyV2(nil, false))+"hello")
+	defer c.Close()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:12345" {
+		t.Fatalf("RemoteAddr = %s", got)
+	}
+	if got := conn.LocalAddr().String(); got != "198.51.100.7:443" {
+		t.Fatalf("LocalAddr = %s", got)
+	}
+	if _, ok := conn.(*putback.PutBackTCPConn); !ok {
+		t.Fatalf("conn is %T", conn)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestProxyListener_SlowClients(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	pl := &putback.ProxyListener{
+		Listener:          l,
+		Policy:            putback.ProxyOptional,
+		ReadHeaderTimeout: 200 * time.Millisecond,
+	}
+	defer pl.Close()
+
+	// A silent client, like one of a server-speaks-first protocol, must not
+	// hold up the client behind it.
+	silent := dialAndWrite(t, l.Addr())
+	start := time.Now()
+	dialAndWrite(t, l.Addr(), string(proxyV2(nil, false))+"hello")
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:12345" {
+		t.Fatalf("RemoteAddr = %s", got)
+	}
+	if d := time.Since(start); d >= 200*time.Millisecond {
+		t.Fatalf("Accept waited %v for the silent client", d)
+	}
+
+	// Once the timeout expires the silent client is accepted without a
+	// header.
+	conn, err = pl.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != silent.LocalAddr().String() {
+		t.Fatalf("RemoteAddr = %s, want %s", got, silent.LocalAddr())
+	}
+	_, _ = silent.Write([]byte("late"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "late" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+
+	_ = pl.Close()
+	if _, err := pl.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected closed listener, got %v", err)
+	}
+}
+
+func TestProxyListener_CloseReleasesPending(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	pl := &putback.ProxyListener{
+		Listener:          l,
+		Policy:            putback.ProxyRequired,
+		ReadHeaderTimeout: -1,
+	}
+	go func() { _, _ = pl.Accept() }()
+
+	// Without a timeout, only Close ends a header that never completes.
+	c := dialAndWrite(t, l.Addr(), "PROXY TCP4 ")
+	time.Sleep(100 * time.Millisecond)
+	_ = pl.Close()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF && !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("pending connection not closed: %v", err)
+	}
+}
+
+func TestProxyHeader_RoundTrip(t *testing.T) {
+	tcp := func(s string) net.Addr { return net.TCPAddrFromAddrPort(netip.MustParseAddrPort(s)) }
+	udp := func(s string) net.Addr { return net.UDPAddrFromAddrPort(netip.MustParseAddrPort(s)) }
+	tlvs := []putback.ProxyTLV{
+		{Type: putback.ProxyTLVAuthority, Value: []byte("example.com")},
+		{Type: putback.ProxyTLVALPN, Value: []byte("h2")},
+		{Type: putback.ProxyTLVCRC32C},
+	}
+	cases := []struct {
+		in      putback.ProxyHeader
+		network string
+		src     string
+	}{
+		{putback.ProxyHeader{Version: 1, Source: tcp("192.0.2.1:1"), Destination: tcp("192.0.2.2:2")}, "tcp4", "192.0.2.1:1"},
+		{putback.ProxyHeader{Version: 1, Source: tcp("[2001:db8::1]:1"), Destination: tcp("[2001:db8::2]:2")}, "tcp6", "[2001:db8::1]:1"},
+		{putback.ProxyHeader{Version: 1, Source: tcp("192.0.2.1:1"), Destination: tcp("[2001:db8::2]:2")}, "tcp6", "192.0.2.1:1"},
+		{putback.ProxyHeader{Version: 1, Source: udp("192.0.2.1:1"), Destination: udp("192.0.2.2:2")}, "", "<nil>"},
+		{putback.ProxyHeader{Version: 2, Source: tcp("192.0.2.1:1"), Destination: tcp("192.0.2.2:2"), TLVs: tlvs}, "tcp4", "192.0.2.1:1"},
+		{putback.ProxyHeader{Version: 2, Source: udp("[2001:db8::1]:1"), Destination: udp("[2001:db8::2]:2")}, "udp6", "[2001:db8::1]:1"},
+		{putback.ProxyHeader{
+			Version:     2,
+			Source:      &net.UnixAddr{Name: "/run/a.sock", Net: "unix"},
+			Destination: &net.UnixAddr{Name: "/run/b.sock", Net: "unix"},
+		}, "unix", "/run/a.sock"},
+		{putback.ProxyHeader{Version: 2, Command: putback.ProxyCmdLocal, TLVs: tlvs}, "", "<nil>"},
+	}
+	for i, tc := range cases {
+		if tc.in.Version == 1 || tc.in.Source != nil {
+			tc.in.Command = putback.ProxyCmdProxy
+		}
+		b, err := tc.in.MarshalBinary()
+		if err != nil {
+			t.Fatalf("case %d: MarshalBinary: %v", i, err)
+		}
+		r := &putback.PutBackReader{Reader: strings.NewReader(string(b) + "x")}
+		h, err := putback.ReadProxyHeader(r)
+		if err != nil || h == nil {
+			t.Fatalf("case %d: ReadProxyHeader(%q) = %v, %v", i, b, h, err)
+		}
+		src := "<nil>"
+		if h.Source != nil {
+			src = h.Source.String()
+		}
+		if h.Version != tc.in.Version || h.Command != tc.in.Command || h.Network != tc.network || src != tc.src {
+			t.Errorf("case %d: got %+v", i, h)
+		}
+		if tc.in.Version == 2 && len(h.TLVs) != len(tc.in.TLVs) {
+			t.Errorf("case %d: TLVs = %v", i, h.TLVs)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "x" {
+			t.Errorf("case %d: payload = %q", i, rest)
+		}
+	}
+}
+
+// writeCounter records the writes made to it.
+type writeCounter struct {
+	writes [][]byte
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, slices.Clone(p))
+	return len(p), nil
+}
+
+func TestWriteProxyHeader_SingleWrite(t *testing.T) {
+	src := &putback.PutBackReader{Reader: strings.NewReader("rest")}
+	src.PutBack([]byte("sniffed "))
+	h := &putback.ProxyHeader{
+		Version:     2,
+		Command:     putback.ProxyCmdProxy,
+		Source:      &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1},
+		Destination: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2},
+	}
+	w := &writeCounter{}
+	if err := putback.WriteProxyHeader(w, h, src); err != nil {
+		t.Fatalf("WriteProxyHeader: %v", err)
+	}
+	if len(w.writes) != 1 {
+		t.Fatalf("got %d writes", len(w.writes))
+	}
+	r := &putback.PutBackReader{Reader: strings.NewReader(string(w.writes[0]))}
+	if _, err := putback.ReadProxyHeader(r); err != nil {
+		t.Fatalf("ReadProxyHeader: %v", err)
+	}
+	if got, _ := io.ReadAll(r); string(got) != "sniffed " {
+		t.Fatalf("payload = %q", got)
+	}
+	if got, _ := io.ReadAll(src); string(got) != "rest" {
+		t.Fatalf("src = %q", got)
+	}
+}
+
+func TestDialProxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	backend := &putback.ProxyListener{Listener: l, Policy: putback.ProxyRequired}
+	defer backend.Close()
+
+	in, client := net.Pipe()
+	defer client.Close()
+	src := &putback.PutBackConn{Conn: in, Meta: putback.Metadata{
+		ClientHello: &putback.ClientHello{ServerName: "example.com"},
+	}}
+	src.PutBack([]byte("hello"))
+
+	h := putback.NewProxyHeader(2, src)
+	h.Source = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	h.Destination = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 443}
+	out, err := putback.DialProxy(context.Background(), nil, "tcp", l.Addr().String(), h, src)
+	if err != nil {
+		t.Fatalf("DialProxy: %v", err)
+	}
+	defer out.Close()
+
+	conn, err := backend.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:1234" {
+		t.Fatalf("RemoteAddr = %s", got)
+	}
+	proxy := conn.(putback.WithMetadata).Metadata().Proxy
+	if v, ok := proxy.TLV(putback.ProxyTLVAuthority); !ok || string(v) != "example.com" {
+		t.Fatalf("authority = %q, %v", v, ok)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
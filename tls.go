@@ -0,0 +1,293 @@
+package putback
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+)
+
+// TLS constants used by the ClientHello parser.
+const (
+	recordTypeHandshake      = 0x16
+	handshakeTypeClientHello = 0x01
+	recordHeaderLen          = 5
+	maxPlaintextLen          = 1 << 14 // largest record fragment allowed
+	handshakeHeaderLen       = 4
+
+	extServerName          = 0
+	extSupportedGroups     = 10
+	extECPointFormats      = 11
+	extSignatureAlgorithms = 13
+	extALPN                = 16
+	extSupportedVersions   = 43
+)
+
+// maxClientHelloLen bounds the size of a ClientHello ReadClientHello buffers.
+const maxClientHelloLen = 1 << 16
+
+var (
+	// ErrNotClientHello is returned by ReadClientHello when the stream does
+	// not start with a TLS handshake record holding a ClientHello.
+	ErrNotClientHello = errors.New("putback: stream does not start with a TLS ClientHello")
+	// ErrMalformedClientHello is returned by ReadClientHello when the
+	// ClientHello cannot be parsed.
+	ErrMalformedClientHello = errors.New("putback: malformed TLS ClientHello")
+)
+
+// ClientHello holds the fields of a TLS ClientHello message that are useful
+// for routing connections without terminating TLS.
+type ClientHello struct {
+	// Version is the legacy_version field.
+	Version            uint16
+	Random             []byte
+	SessionID          []byte
+	CipherSuites       []uint16
+	CompressionMethods []byte
+	// ServerName is the host name of the server_name extension, if any.
+	ServerName string
+	// ALPNProtocols are the protocols of the ALPN extension, if any.
+	ALPNProtocols []string
+	// SupportedVersions are the versions of the supported_versions
+	// extension, if any.
+	SupportedVersions []uint16
+	// Extensions are the extension types in the order they were sent.
+	Extensions []uint16
+	// SupportedGroups, ECPointFormats and SignatureAlgorithms are the
+	// values of the respective extensions, if any.
+	SupportedGroups     []uint16
+	ECPointFormats      []uint8
+	SignatureAlgorithms []uint16
+	// Raw is the whole handshake message, including its 4-byte header.
+	Raw []byte
+}
+
+// ReadClientHello peeks the TLS ClientHello at the start of r and parses it.
+// A ClientHello may be split across several TLS records and arrive in several
+// reads; ReadClientHello reads exactly the records it needs. Every byte it
+// reads is put back into r, so the stream stays byte-for-byte intact for the
+// TLS server that eventually handles it.
+func ReadClientHello(r PutBacker) (*ClientHello, error) {
+	msg, err := peekHandshake(r)
+	if err != nil {
+		return nil, err
+	}
+	hello, ok := parseClientHello(msg)
+	if !ok {
+		return nil, ErrMalformedClientHello
+	}
+	return hello, nil
+}
+
+// peekHandshake peeks TLS handshake records from r until the first handshake
+// message is complete and returns that message. Records are read one at a
+// time and put back together at the end, so every byte is read only once.
+func peekHandshake(r PutBacker) ([]byte, error) {
+	var (
+		raw    []byte // bytes of records read so far
+		msg    []byte // handshake payload reassembled from records
+		msgLen = -1   // length of the handshake message, once known
+	)
+	defer func() { r.PutBack(raw) }()
+	// next reads the following n bytes of r into raw and returns them.
+	next := func(n int) ([]byte, error) {
+		raw = slices.Grow(raw, n)
+		got, err := io.ReadFull(r, raw[len(raw):len(raw)+n])
+		raw = raw[:len(raw)+got]
+		return raw[len(raw)-got:], err
+	}
+	for msgLen < 0 || len(msg) < msgLen {
+		notTLS := ErrMalformedClientHello
+		if len(raw) == 0 {
+			notTLS = ErrNotClientHello
+		}
+		header, err := next(recordHeaderLen)
+		if err != nil {
+			return nil, err
+		}
+		if header[0] != recordTypeHandshake || header[1] != 3 {
+			return nil, notTLS
+		}
+		fragLen := int(binary.BigEndian.Uint16(header[3:]))
+		if fragLen > maxPlaintextLen {
+			return nil, notTLS
+		}
+		if fragLen == 0 {
+			return nil, ErrMalformedClientHello
+		}
+		fragment, err := next(fragLen)
+		if err != nil {
+			return nil, err
+		}
+		msg = append(msg, fragment...)
+		if msgLen < 0 && len(msg) >= handshakeHeaderLen {
+			if msg[0] != handshakeTypeClientHello {
+				return nil, ErrNotClientHello
+			}
+			msgLen = handshakeHeaderLen + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+			if msgLen > maxClientHelloLen {
+				return nil, ErrMalformedClientHello
+			}
+		}
+	}
+	return msg[:msgLen], nil
+}
+
+// parseClientHello parses a ClientHello handshake message.
+func parseClientHello(msg []byte) (*ClientHello, bool) {
+	hello := &ClientHello{Raw: msg}
+	s := byteString(msg[handshakeHeaderLen:])
+	var ciphers, compression, sessionID, exts byteString
+	if !s.readUint16(&hello.Version) ||
+		!s.readBytes(32, &hello.Random) ||
+		!s.readUint8Prefixed(&sessionID) ||
+		!s.readUint16Prefixed(&ciphers) ||
+		!s.readUint8Prefixed(&compression) {
+		return nil, false
+	}
+	hello.SessionID = sessionID
+	hello.CompressionMethods = compression
+	if !ciphers.readUint16s(&hello.CipherSuites) {
+		return nil, false
+	}
+	if s.empty() {
+		// extensions are optional
+		return hello, true
+	}
+	if !s.readUint16Prefixed(&exts) || !s.empty() {
+		return nil, false
+	}
+	for !exts.empty() {
+		var typ uint16
+		var data byteString
+		if !exts.readUint16(&typ) || !exts.readUint16Prefixed(&data) {
+			return nil, false
+		}
+		hello.Extensions = append(hello.Extensions, typ)
+		if !hello.parseExtension(typ, data) {
+			return nil, false
+		}
+	}
+	return hello, true
+}
+
+// parseExtension stores the fields of the extensions ClientHello exposes.
+func (h *ClientHello) parseExtension(typ uint16, data byteString) bool {
+	switch typ {
+	case extServerName:
+		var names byteString
+		if !data.readUint16Prefixed(&names) {
+			return false
+		}
+		for !names.empty() {
+			var nameType uint8
+			var name byteString
+			if !names.readUint8(&nameType) || !names.readUint16Prefixed(&name) {
+				return false
+			}
+			if nameType == 0 {
+				h.ServerName = string(name)
+			}
+		}
+	case extALPN:
+		var protos byteString
+		if !data.readUint16Prefixed(&protos) {
+			return false
+		}
+		for !protos.empty() {
+			var proto byteString
+			if !protos.readUint8Prefixed(&proto) || proto.empty() {
+				return false
+			}
+			h.ALPNProtocols = append(h.ALPNProtocols, string(proto))
+		}
+	case extSupportedVersions:
+		var versions byteString
+		return data.readUint8Prefixed(&versions) && versions.readUint16s(&h.SupportedVersions)
+	case extSupportedGroups:
+		var groups byteString
+		return data.readUint16Prefixed(&groups) && groups.readUint16s(&h.SupportedGroups)
+	case extSignatureAlgorithms:
+		var algs byteString
+		return data.readUint16Prefixed(&algs) && algs.readUint16s(&h.SignatureAlgorithms)
+	case extECPointFormats:
+		var formats byteString
+		if !data.readUint8Prefixed(&formats) {
+			return false
+		}
+		h.ECPointFormats = formats
+	}
+	return true
+}
+
+// byteString is a cursor over a byte slice for parsing TLS structures.
+type byteString []byte
+
+func (s *byteString) empty() bool {
+	return len(*s) == 0
+}
+
+func (s *byteString) read(n int) ([]byte, bool) {
+	if n < 0 || len(*s) < n {
+		return nil, false
+	}
+	v := (*s)[:n]
+	*s = (*s)[n:]
+	return v, true
+}
+
+func (s *byteString) readUint8(out *uint8) bool {
+	v, ok := s.read(1)
+	if ok {
+		*out = v[0]
+	}
+	return ok
+}
+
+func (s *byteString) readUint16(out *uint16) bool {
+	v, ok := s.read(2)
+	if ok {
+		*out = binary.BigEndian.Uint16(v)
+	}
+	return ok
+}
+
+// readUint16s consumes the rest of s as a list of uint16 values.
+func (s *byteString) readUint16s(out *[]uint16) bool {
+	for !s.empty() {
+		var v uint16
+		if !s.readUint16(&v) {
+			return false
+		}
+		*out = append(*out, v)
+	}
+	return true
+}
+
+func (s *byteString) readBytes(n int, out *[]byte) bool {
+	v, ok := s.read(n)
+	if ok {
+		*out = v
+	}
+	return ok
+}
+
+func (s *byteString) readUint8Prefixed(out *byteString) bool {
+	var n uint8
+	if !s.readUint8(&n) {
+		return false
+	}
+	v, ok := s.read(int(n))
+	*out = v
+	return ok
+}
+
+func (s *byteString) readUint16Prefixed(out *byteString) bool {
+	var n uint16
+	if !s.readUint16(&n) {
+		return false
+	}
+	v, ok := s.read(int(n))
+	*out = v
+	return ok
+}
@@ -0,0 +1,177 @@
+package putback_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"slices"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/asciimoth/putback"
+)
+
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// captureClientHello returns the first TLS record a crypto/tls client sends.
+func captureClientHello(t *testing.T, cfg *tls.Config) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_ = tls.Client(client, cfg).Handshake()
+		_ = client.Close()
+	}()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatalf("read record header: %v", err)
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatalf("read record: %v", err)
+	}
+	return record
+}
+
+// refragment splits the handshake data of a single TLS record into records
+// of at most size bytes.
+func refragment(record []byte, size int) []byte {
+	var out []byte
+	for data := record[5:]; len(data) > 0; {
+		n := min(size, len(data))
+		out = append(out, record[0], record[1], record[2], byte(n>>8), byte(n))
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out
+}
+
+func TestReadClientHello_Handshake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			ServerName:         "example.com",
+			NextProtos:         []string{"h2", "http/1.1"},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			done <- err
+			return
+		}
+		defer c.Close()
+		_, err = c.Write([]byte("ping"))
+		done <- err
+	}()
+
+	raw, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	conn := putback.WrapConn(raw, nil, nil)
+	defer conn.Close()
+
+	hello, err := putback.ReadClientHello(conn.(putback.PutBacker))
+	if err != nil {
+		t.Fatalf("read ClientHello: %v", err)
+	}
+	if hello.ServerName != "example.com" {
+		t.Fatalf("unexpected SNI %q", hello.ServerName)
+	}
+	if !slices.Equal(hello.ALPNProtocols, []string{"h2", "http/1.1"}) {
+		t.Fatalf("unexpected ALPN %q", hello.ALPNProtocols)
+	}
+	if !slices.Contains(hello.SupportedVersions, tls.VersionTLS13) || len(hello.CipherSuites) == 0 {
+		t.Fatalf("unexpected versions %x or suites %x", hello.SupportedVersions, hello.CipherSuites)
+	}
+
+	// The TLS server must see the untouched ClientHello.
+	server := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}})
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(server, b); err != nil || string(b) != "ping" {
+		t.Fatalf("read through TLS: %q %v", b, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("client: %v", err)
+	}
+}
+
+func TestReadClientHello_Fragmented(t *testing.T) {
+	record := captureClientHello(t, &tls.Config{
+		ServerName:         "fragmented.example",
+		InsecureSkipVerify: true,
+		// Large post-quantum key shares make real ClientHellos span
+		// several records and segments.
+		CurvePreferences: []tls.CurveID{tls.X25519MLKEM768, tls.X25519},
+	})
+	stream := append(refragment(record, 100), "trailing"...)
+	r := &putback.PutBackReader{Reader: iotest.OneByteReader(bytes.NewReader(stream))}
+
+	hello, err := putback.ReadClientHello(r)
+	if err != nil {
+		t.Fatalf("read ClientHello: %v", err)
+	}
+	if hello.ServerName != "fragmented.example" || len(hello.Raw) != len(record)-5 {
+		t.Fatalf("unexpected hello: %q, %d bytes", hello.ServerName, len(hello.Raw))
+	}
+	rest, _ := io.ReadAll(r)
+	if !bytes.Equal(rest, stream) {
+		t.Fatalf("stream was not left intact")
+	}
+}
+
+func TestReadClientHello_NotTLS(t *testing.T) {
+	r := &putback.PutBackReader{Reader: bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n"))}
+	if _, err := putback.ReadClientHello(r); !errors.Is(err, putback.ErrNotClientHello) {
+		t.Fatalf("expected ErrNotClientHello, got %v", err)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "GET / HTTP/1.1\r\n\r\n" {
+		t.Fatalf("stream was not left intact: %q", rest)
+	}
+}
+
+func TestReadClientHello_OversizedRecord(t *testing.T) {
+	// A record longer than 2^14 bytes is not TLS, however much follows.
+	stream := append([]byte{0x16, 0x03, 0x01, 0x40, 0x01}, make([]byte, 1<<14+1)...)
+	r := &putback.PutBackReader{Reader: bytes.NewReader(stream)}
+	if _, err := putback.ReadClientHello(r); !errors.Is(err, putback.ErrNotClientHello) {
+		t.Fatalf("expected ErrNotClientHello, got %v", err)
+	}
+	rest, _ := io.ReadAll(r)
+	if !bytes.Equal(rest, stream) {
+		t.Fatalf("stream was not left intact")
+	}
+}
@@ -0,0 +1,144 @@
+package putback
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// webSocketGUID is appended to Sec-WebSocket-Key to compute
+// Sec-WebSocket-Accept (RFC 6455 4.2.2).
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	// ErrNotUpgrade is returned by ReadUpgrade for requests that do not ask
+	// for a protocol upgrade.
+	ErrNotUpgrade = errors.New("putback: not an HTTP upgrade request")
+	// ErrInvalidUpgradeProtocol is returned by WriteSwitchingProtocols when
+	// the protocol is not a valid Upgrade header value.
+	ErrInvalidUpgradeProtocol = errors.New("putback: invalid upgrade protocol")
+)
+
+// UpgradeRequest is an HTTP/1.1 request asking to switch protocols.
+type UpgradeRequest struct {
+	Head *RequestHead
+	// Protocols lists the protocols of the Upgrade header in order of
+	// preference, such as "websocket" or "h2c".
+	Protocols []string
+}
+
+// Wants reports whether protocol is among the requested Protocols, compared
+// case-insensitively and ignoring versions such as "/13".
+func (u *UpgradeRequest) Wants(protocol string) bool {
+	for _, p := range u.Protocols {
+		name, _, _ := strings.Cut(p, "/")
+		if strings.EqualFold(name, protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTP2Settings decodes the HTTP2-Settings header of an h2c upgrade
+// request (RFC 7540 3.2.1).
+func (u *UpgradeRequest) HTTP2Settings() ([]HTTP2Setting, error) {
+	values := u.Head.Header.Values("Http2-Settings")
+	if len(values) != 1 {
+		return nil, ErrMalformedRequestHead
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(values[0], "="))
+	if err != nil || len(payload)%6 != 0 {
+		return nil, ErrMalformedRequestHead
+	}
+	settings := make([]HTTP2Setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		settings = append(settings, HTTP2Setting{
+			ID:    binary.BigEndian.Uint16(payload[i:]),
+			Value: binary.BigEndian.Uint32(payload[i+2:]),
+		})
+	}
+	return settings, nil
+}
+
+// WebSocketAccept returns the Sec-WebSocket-Accept value answering the
+// Sec-WebSocket-Key of a WebSocket upgrade request.
+func (u *UpgradeRequest) WebSocketAccept() string {
+	sum := sha1.Sum([]byte(strings.TrimSpace(u.Head.Header.Get("Sec-Websocket-Key")) + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ReadUpgrade reads an HTTP/1.1 upgrade request head from conn and consumes
+// it. The returned connection is a PutBackConn or PutBackTCPConn whose
+// BackBuffer holds exactly the bytes that were read past the head, such as
+// the client's first frames or the h2c connection preface, so the new
+// protocol's handler reads them first and in order. A request body, if
+// any, also follows the head. Connections that are not PutBackConn or
+// PutBackTCPConn yet are wrapped with WrapConn first.
+//
+// If the request does not ask for an upgrade, ErrNotUpgrade is returned and
+// the head is left in place, so the connection can be handed to an
+// HTTP/1.x server instead. The returned connection is non-nil even on
+// error. A limit of 0 means DefaultMaxHeadBytes.
+func ReadUpgrade(conn net.Conn, limit int, pool BufferPool) (*UpgradeRequest, net.Conn, error) {
+	conn = withPutBack(conn, pool)
+	h, err := ReadRequestHead(conn.(PutBacker), limit)
+	if err != nil {
+		return nil, conn, err
+	}
+	if !headerHasToken(h.Header, "Connection", "upgrade") || h.Proto != "HTTP/1.1" {
+		return nil, conn, ErrNotUpgrade
+	}
+	u := &UpgradeRequest{Head: h}
+	for _, value := range h.Header.Values("Upgrade") {
+		for _, p := range strings.Split(value, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				u.Protocols = append(u.Protocols, p)
+			}
+		}
+	}
+	if len(u.Protocols) == 0 {
+		return nil, conn, ErrNotUpgrade
+	}
+	if err := discard(conn, len(h.Raw)); err != nil {
+		return nil, conn, err
+	}
+	return u, conn, nil
+}
+
+// WriteSwitchingProtocols writes a 101 Switching Protocols response that
+// accepts protocol, with the additional header fields of header, which may
+// be nil. protocol is a comma-separated list of protocols, each a token
+// optionally followed by "/" and a version token, such as "websocket" or
+// "HTTP/2.0, h2c"; anything else returns ErrInvalidUpgradeProtocol.
+func WriteSwitchingProtocols(w io.Writer, protocol string, header http.Header) error {
+	if !validUpgradeProtocols(protocol) {
+		return ErrInvalidUpgradeProtocol
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n", protocol)
+	if err := header.Write(&buf); err != nil {
+		return err
+	}
+	buf.WriteString("\r\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// validUpgradeProtocols reports whether s is a valid Upgrade header value
+// (RFC 9110 7.8).
+func validUpgradeProtocols(s string) bool {
+	for _, p := range strings.Split(s, ",") {
+		name, version, found := strings.Cut(strings.Trim(p, " \t"), "/")
+		if !isToken(name) || found && !isToken(version) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package putback_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/asciimoth/putback"
+)
+
+func TestReadUpgrade_WebSocket(t *testing.T) {
+	const head = "GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\n" +
+		"Connection: keep-alive, Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	// A masked text frame sent right behind the request.
+	frame := "\x81\x85\x37\xfa\x21\x3d\x7f\x9f\x4d\x51\x58"
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() { _, _ = client.Write([]byte(head + frame)) }()
+
+	u, conn, err := putback.ReadUpgrade(server, 0, nil)
+	if err != nil {
+		t.Fatalf("ReadUpgrade: %v", err)
+	}
+	defer conn.Close()
+	if !u.Wants("websocket") || u.Wants("h2c") || u.Head.Target != "/chat" {
+		t.Fatalf("upgrade = %+v", u)
+	}
+	if got := u.WebSocketAccept(); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("WebSocketAccept = %q", got)
+	}
+	if left := conn.(*putback.PutBackConn).Buffer.BytesLeft(); left != len(frame) {
+		t.Fatalf("buffered %d bytes, want %d", left, len(frame))
+	}
+	buf := make([]byte, len(frame))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != frame {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestReadUpgrade_H2C(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	const head = "OPTIONS * HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\n" +
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA\r\n\r\n"
+	settings := string(h2Frame(0x4, 0, 0, nil))
+	c := dialAndWrite(t, l.Addr(), head+putback.HTTP2Preface[:10], putback.HTTP2Preface[10:]+settings)
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+
+	u, conn, err := putback.ReadUpgrade(server, 0, nil)
+	if err != nil {
+		t.Fatalf("ReadUpgrade: %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*putback.PutBackTCPConn); !ok {
+		t.Fatalf("conn is %T", conn)
+	}
+	if !u.Wants("h2c") {
+		t.Fatalf("protocols = %q", u.Protocols)
+	}
+	got, err := u.HTTP2Settings()
+	if err != nil {
+		t.Fatalf("HTTP2Settings: %v", err)
+	}
+	want := []putback.HTTP2Setting{{ID: 3, Value: 100}, {ID: 4, Value: 1 << 30}, {ID: 2, Value: 0}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Fatalf("settings = %v", got)
+	}
+
+	if err := putback.WriteSwitchingProtocols(conn, "h2c", nil); err != nil {
+		t.Fatalf("WriteSwitchingProtocols: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "h2c" {
+		t.Fatalf("response = %v, %v", resp, err)
+	}
+
+	buf := make([]byte, len(putback.HTTP2Preface)+len(settings))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != putback.HTTP2Preface+settings {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestReadUpgrade_NotUpgrade(t *testing.T) {
+	const req = "GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\n\r\n"
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() { _, _ = client.Write([]byte(req)) }()
+
+	_, conn, err := putback.ReadUpgrade(server, 0, nil)
+	defer conn.Close()
+	if !errors.Is(err, putback.ErrNotUpgrade) {
+		t.Fatalf("err = %v", err)
+	}
+	buf := make([]byte, len(req))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != req {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestWriteSwitchingProtocols_Protocol(t *testing.T) {
+	for protocol, valid := range map[string]bool{
+		"websocket":              true,
+		"HTTP/2.0, h2c":          true,
+		"h2c,\tIRC/6.9":          true,
+		"":                       false,
+		"h2c,":                   false,
+		"HTTP/":                  false,
+		"h2c\r\nSet-Cookie: a=b": false,
+		"web socket":             false,
+	} {
+		var buf bytes.Buffer
+		err := putback.WriteSwitchingProtocols(&buf, protocol, nil)
+		if valid && err != nil {
+			t.Errorf("%q: %v", protocol, err)
+		}
+		if !valid && (!errors.Is(err, putback.ErrInvalidUpgradeProtocol) || buf.Len() != 0) {
+			t.Errorf("%q: err = %v, wrote %q", protocol, err, buf.Bytes())
+		}
+	}
+}
@@ -51,6 +51,12 @@ func (pb *PutBackReadCloser) Read(p []byte) (n int, err error) {
 	return readJoin(&pb.Buffer, pb.ReadCloser, p)
 }
 
+// Peek returns up to n upcoming bytes without consuming them, like the Peek
+// function.
+func (pb *PutBackReadCloser) Peek(n int) ([]byte, error) {
+	return Peek(pb, n)
+}
+
 // PutBackReadWriter wraps an io.ReadWriter with put-back support for reads.
 type PutBackReadWriter struct {
 	io.ReadWriter
@@ -95,6 +101,30 @@ func (pb *PutBackReadWriteCloser) Read(p []byte) (n int, err error) {
 type PutBackConn struct {
 	net.Conn
 	Buffer BackBuffer
+	Meta   Metadata
+}
+
+// Metadata returns what was learned about the connection while sniffing it.
+func (pb *PutBackConn) Metadata() *Metadata {
+	return &pb.Meta
+}
+
+// RemoteAddr returns the source address carried by a PROXY protocol header
+// recorded in Meta, or the remote address of the underlying Conn.
+func (pb *PutBackConn) RemoteAddr() net.Addr {
+	if addr := pb.Meta.remoteAddr(); addr != nil {
+		return addr
+	}
+	return pb.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address carried by a PROXY protocol
+// header recorded in Meta, or the local address of the underlying Conn.
+func (pb *PutBackConn) LocalAddr() net.Addr {
+	if addr := pb.Meta.localAddr(); addr != nil {
+		return addr
+	}
+	return pb.Conn.LocalAddr()
 }
 
 // PutBack prepends bytes so they will be read before the underlying Conn.
@@ -118,6 +148,30 @@ func (pb *PutBackConn) Read(p []byte) (n int, err error) {
 type PutBackTCPConn struct {
 	TCPConn
 	Buffer BackBuffer
+	Meta   Metadata
+}
+
+// Metadata returns what was learned about the connection while sniffing it.
+func (pb *PutBackTCPConn) Metadata() *Metadata {
+	return &pb.Meta
+}
+
+// RemoteAddr returns the source address carried by a PROXY protocol header
+// recorded in Meta, or the remote address of the underlying Conn.
+func (pb *PutBackTCPConn) RemoteAddr() net.Addr {
+	if addr := pb.Meta.remoteAddr(); addr != nil {
+		return addr
+	}
+	return pb.TCPConn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address carried by a PROXY protocol
+// header recorded in Meta, or the local address of the underlying Conn.
+func (pb *PutBackTCPConn) LocalAddr() net.Addr {
+	if addr := pb.Meta.localAddr(); addr != nil {
+		return addr
+	}
+	return pb.TCPConn.LocalAddr()
 }
 
 // PutBack prepends bytes so they will be read before the underlying Conn.
@@ -157,10 +211,24 @@ type PutBackPacketConn struct {
 }
 
 // PutBack pushes a packet back so it will be returned by the next ReadFrom.
+// Ownership of bytes is handed to the buffer; see
+// BackPacketBuffer.PutBack.
 func (pb *PutBackPacketConn) PutBack(bytes []byte, addr net.Addr) {
 	pb.Buffer.PutBack(bytes, addr)
 }
 
+// PutBackCopy is like PutBack but stores a copy of bytes, so the caller may
+// reuse its read buffer.
+func (pb *PutBackPacketConn) PutBackCopy(bytes []byte, addr net.Addr) {
+	pb.Buffer.PutBackCopy(bytes, addr)
+}
+
+// Append queues a packet after all buffered packets, so packets appended in
+// turn are replayed in the order they arrived.
+func (pb *PutBackPacketConn) Append(bytes []byte, addr net.Addr) {
+	pb.Buffer.Append(bytes, addr)
+}
+
 // Close wipes the internal packet buffer and then closes the underlying
 // PacketConn.
 func (pb *PutBackPacketConn) Close() error {
@@ -171,25 +239,118 @@ func (pb *PutBackPacketConn) Close() error {
 // ReadFrom first attempts to read a packet from the internal buffer. If none
 // are available it delegates to the underlying PacketConn.
 func (pb *PutBackPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	n, addr, err = pb.Buffer.ReadFrom(p)
-	if n != 0 {
+	var ok bool
+	n, addr, ok, err = pb.Buffer.TryReadFrom(p)
+	if ok {
 		return
 	}
 	return pb.PacketConn.ReadFrom(p)
 }
 
+// PeekFrom returns the next packet without consuming it. A buffered packet is
+// copied into p in place; otherwise a packet is read from the underlying
+// PacketConn and kept in the buffer, so the next ReadFrom returns the same
+// packet and address. Packets larger than p are truncated in p only. If the
+// buffer refuses the packet because of its Limits, the packet is returned
+// together with the error and is not kept.
+func (pb *PutBackPacketConn) PeekFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, ok := pb.Buffer.PeekFrom(p)
+	if ok {
+		return
+	}
+	buf, addr, err := readPacket(pb.Buffer.Pool, pb.PacketConn.ReadFrom)
+	if err != nil {
+		return 0, nil, err
+	}
+	n = copy(p, buf)
+	if err = pb.Buffer.TryPutBack(Packet[net.Addr]{Buffer: buf, Assoc: addr}); err != nil {
+		releaseBuffer(pb.Buffer.Pool, buf)
+	}
+	return
+}
+
 // PutBackUDPConn wraps a UDPConn and allows UDP packets to be put back and
 // re-read. It supports the common UDP read variants provided by net.UDPConn.
+// Packets put back with a netip.AddrPort keep it next to the *net.UDPAddr
+// stored in Buffer, so reading them back with ReadFromUDP or
+// ReadFromUDPAddrPort does not allocate.
 type PutBackUDPConn struct {
 	UDPConn
 	Buffer BackPacketBuffer[*net.UDPAddr]
 }
 
+// udpPacket returns a packet for a datagram from addr that keeps the address
+// in both forms.
+func udpPacket(bytes, oob []byte, flags int, addr netip.AddrPort) Packet[*net.UDPAddr] {
+	packet := Packet[*net.UDPAddr]{Buffer: bytes, OOB: oob, Flags: flags, addrPort: addr}
+	if addr.IsValid() {
+		packet.Assoc = net.UDPAddrFromAddrPort(addr)
+	}
+	return packet
+}
+
+// udpPacketAddrPort returns the address of a buffered packet as a
+// netip.AddrPort.
+func udpPacketAddrPort(packet Packet[*net.UDPAddr]) netip.AddrPort {
+	if packet.addrPort.IsValid() {
+		return packet.addrPort
+	}
+	return udpAddrToAddrPort(packet.Assoc)
+}
+
 // PutBack pushes a packet back so it will be returned by the next reads.
+// Ownership of bytes is handed to the buffer; see
+// BackPacketBuffer.PutBack.
 func (pb *PutBackUDPConn) PutBack(bytes []byte, addr *net.UDPAddr) {
 	pb.Buffer.PutBack(bytes, addr)
 }
 
+// PutBackCopy is like PutBack but stores a copy of bytes, so the caller may
+// reuse its read buffer.
+func (pb *PutBackUDPConn) PutBackCopy(bytes []byte, addr *net.UDPAddr) {
+	pb.Buffer.PutBackCopy(bytes, addr)
+}
+
+// PutBackAddrPort is like PutBack but takes the address as a netip.AddrPort.
+func (pb *PutBackUDPConn) PutBackAddrPort(bytes []byte, addr netip.AddrPort) {
+	pb.Buffer.put(udpPacket(bytes, nil, 0, addr), 0)
+}
+
+// PutBackMsg pushes a packet back together with its out-of-band data and
+// message flags so ReadMsgUDP and ReadMsgUDPAddrPort replay them as well.
+func (pb *PutBackUDPConn) PutBackMsg(bytes, oob []byte, flags int, addr *net.UDPAddr) {
+	pb.Buffer.PutBackMsg(bytes, oob, flags, addr)
+}
+
+// PutBackMsgAddrPort is like PutBackMsg but takes the address as a
+// netip.AddrPort.
+func (pb *PutBackUDPConn) PutBackMsgAddrPort(bytes, oob []byte, flags int, addr netip.AddrPort) {
+	pb.Buffer.put(udpPacket(bytes, oob, flags, addr), 0)
+}
+
+// Append queues a packet after all buffered packets, so packets appended in
+// turn are replayed in the order they arrived.
+func (pb *PutBackUDPConn) Append(bytes []byte, addr *net.UDPAddr) {
+	pb.Buffer.Append(bytes, addr)
+}
+
+// AppendAddrPort is like Append but takes the address as a netip.AddrPort.
+func (pb *PutBackUDPConn) AppendAddrPort(bytes []byte, addr netip.AddrPort) {
+	pb.Buffer.put(udpPacket(bytes, nil, 0, addr), -1)
+}
+
+// AppendMsg is like Append but also stores the out-of-band data and message
+// flags of the packet.
+func (pb *PutBackUDPConn) AppendMsg(bytes, oob []byte, flags int, addr *net.UDPAddr) {
+	pb.Buffer.AppendMsg(bytes, oob, flags, addr)
+}
+
+// AppendMsgAddrPort is like AppendMsg but takes the address as a
+// netip.AddrPort.
+func (pb *PutBackUDPConn) AppendMsgAddrPort(bytes, oob []byte, flags int, addr netip.AddrPort) {
+	pb.Buffer.put(udpPacket(bytes, oob, flags, addr), -1)
+}
+
 // Close wipes the internal packet buffer and then closes the underlying
 // UDPConn.
 func (pb *PutBackUDPConn) Close() error {
@@ -200,44 +361,103 @@ func (pb *PutBackUDPConn) Close() error {
 // ReadFromUDP reads a packet from the internal buffer first and falls back to
 // the underlying UDPConn if no buffered packets are available.
 func (pb *PutBackUDPConn) ReadFromUDP(b []byte) (n int, addr *net.UDPAddr, err error) {
-	n, addr, err = pb.Buffer.ReadFrom(b)
-	if n != 0 {
+	var ok bool
+	n, addr, ok, err = pb.Buffer.TryReadFrom(b)
+	if ok {
 		return
 	}
 	return pb.UDPConn.ReadFromUDP(b)
 }
 
-// ReadMsgUDP is implemented in terms of ReadFromUDP. OOB data is not
-// supported and oobn and flags are always zero.
+// ReadMsgUDP reads a packet with its out-of-band data from the internal
+// buffer first and falls back to the underlying UDPConn if no buffered
+// packets are available. Truncated buffered packets are reported with
+// MsgTrunc in flags, as a socket would.
 func (pb *PutBackUDPConn) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
-	n, addr, err = pb.ReadFromUDP(b)
-	return
+	var ok bool
+	n, oobn, flags, addr, ok, err = pb.Buffer.TryReadMsg(b, oob)
+	if ok {
+		return
+	}
+	return pb.UDPConn.ReadMsgUDP(b, oob)
 }
 
 // ReadFrom implements net.PacketConn by delegating to ReadFromUDP.
 func (pb *PutBackUDPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	return pb.ReadFromUDP(p)
+	n, ua, err := pb.ReadFromUDP(p)
+	if ua == nil {
+		return n, nil, err
+	}
+	return n, ua, err
 }
 
 // ReadFromUDPAddrPort reads a packet returning a netip.AddrPort. Buffered
 // packets are returned first, falling back to the underlying UDPConn.
 func (pb *PutBackUDPConn) ReadFromUDPAddrPort(b []byte) (n int, addr netip.AddrPort, err error) {
-	var ua *net.UDPAddr
-	n, ua, err = pb.Buffer.ReadFrom(b)
-	if n != 0 {
-		addr = udpAddrToAddrPort(ua)
-		return
+	n, _, _, packet, ok, err := pb.Buffer.readMsg(b, nil)
+	if ok {
+		return n, udpPacketAddrPort(packet), err
 	}
 	return pb.UDPConn.ReadFromUDPAddrPort(b)
 }
 
-// ReadMsgUDPAddrPort is implemented in terms of ReadFromUDPAddrPort. OOB data
-// is not supported and oobn and flags are always zero.
+// ReadMsgUDPAddrPort is like ReadMsgUDP but returns the source address as a
+// netip.AddrPort.
 func (pb *PutBackUDPConn) ReadMsgUDPAddrPort(b, oob []byte) (n, oobn, flags int, addr netip.AddrPort, err error) {
-	n, addr, err = pb.ReadFromUDPAddrPort(b)
+	n, oobn, flags, packet, ok, err := pb.Buffer.readMsg(b, oob)
+	if ok {
+		return n, oobn, flags, udpPacketAddrPort(packet), err
+	}
+	return pb.UDPConn.ReadMsgUDPAddrPort(b, oob)
+}
+
+// peekUDP returns the next packet without consuming it, reading it from the
+// underlying UDPConn into the buffer if none is buffered. Only the metadata
+// of the returned packet may be used.
+func (pb *PutBackUDPConn) peekUDP(p []byte) (n int, packet Packet[*net.UDPAddr], err error) {
+	packet, ok := pb.Buffer.peek()
+	if ok {
+		return copy(p, packet.Buffer), packet, nil
+	}
+	buf, addr, err := readPacket(pb.Buffer.Pool, pb.UDPConn.ReadFromUDPAddrPort)
+	if err != nil {
+		return 0, packet, err
+	}
+	packet = udpPacket(buf, nil, 0, addr)
+	n = copy(p, buf)
+	if err = pb.Buffer.TryPutBack(packet); err != nil {
+		releaseBuffer(pb.Buffer.Pool, buf)
+	}
 	return
 }
 
+// PeekFromUDP returns the next packet without consuming it. A buffered packet
+// is copied into p in place; otherwise a packet is read from the underlying
+// UDPConn and kept in the buffer, so the next read returns the same packet
+// and address. Out-of-band data of packets read by a peek is not preserved.
+// If the buffer refuses the packet because of its Limits, the packet is
+// returned together with the error and is not kept.
+func (pb *PutBackUDPConn) PeekFromUDP(p []byte) (n int, addr *net.UDPAddr, err error) {
+	n, packet, err := pb.peekUDP(p)
+	return n, packet.Assoc, err
+}
+
+// PeekFrom is like PeekFromUDP but returns the address as a net.Addr.
+func (pb *PutBackUDPConn) PeekFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, packet, err := pb.peekUDP(p)
+	if packet.Assoc == nil {
+		return n, nil, err
+	}
+	return n, packet.Assoc, err
+}
+
+// PeekFromUDPAddrPort is like PeekFromUDP but returns the address as a
+// netip.AddrPort.
+func (pb *PutBackUDPConn) PeekFromUDPAddrPort(p []byte) (n int, addr netip.AddrPort, err error) {
+	n, packet, err := pb.peekUDP(p)
+	return n, udpPacketAddrPort(packet), err
+}
+
 // Read implements io.Reader by reading a UDP packet and discarding the source
 // address.
 func (pb *PutBackUDPConn) Read(p []byte) (n int, err error) {
@@ -248,22 +468,28 @@ func (pb *PutBackUDPConn) Read(p []byte) (n int, err error) {
 // WrapConn wraps a net.Conn with a put-back capable connection. Any initial
 // bytes are made available for reading before data from the connection. If
 // the provided connection already supports put-back, its existing buffer is
-// reused as the parent. TCP connections are wrapped with PutBackTCPConn to
-// preserve TCP-specific methods.
+// reused as the parent and its Metadata is carried over. TCP connections are
+// wrapped with PutBackTCPConn to preserve TCP-specific methods.
 func WrapConn(conn net.Conn, bytes []byte, pool BufferPool) net.Conn {
 	var parent WithBackBuffer
 	if p, ok := conn.(WithBackBuffer); ok {
 		parent = p
 	}
+	var meta Metadata
+	if m, ok := conn.(WithMetadata); ok {
+		meta = *m.Metadata()
+	}
 	buf := NewBackBuffer(pool, parent, bytes)
 	if tcp, ok := conn.(TCPConn); ok {
 		return &PutBackTCPConn{
 			TCPConn: tcp,
 			Buffer:  buf,
+			Meta:    meta,
 		}
 	}
 	return &PutBackConn{
 		Conn:   conn,
 		Buffer: buf,
+		Meta:   meta,
 	}
 }